@@ -17,22 +17,49 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 )
 
 type commentData struct {
-	Fails   []string
-	Warns   []string
-	DocsURL string
+	Fails        []string
+	Warns        []string
+	PolicyErrors []string
+	Exceptions   []string
+	Severities   []severityGroup
+	Summary      *commentSummary
+	Successes    int
+	DocsURL      string
+	GistURL      string
+	Version      string
+	Marker       string
 }
 
 type jsonResult struct {
@@ -41,10 +68,12 @@ type jsonResult struct {
 }
 
 type jsonCheckResult struct {
-	Filename  string       `json:"filename"`
-	Successes []jsonResult `json:"successes"`
-	Warnings  []jsonResult `json:"warnings,omitempty"`
-	Failures  []jsonResult `json:"failures,omitempty"`
+	Filename   string       `json:"filename"`
+	Namespace  string       `json:"namespace,omitempty"`
+	Successes  []jsonResult `json:"successes"`
+	Warnings   []jsonResult `json:"warnings,omitempty"`
+	Failures   []jsonResult `json:"failures,omitempty"`
+	Exceptions []jsonResult `json:"exceptions,omitempty"`
 }
 
 type metricsSubmission struct {
@@ -52,319 +81,4804 @@ type metricsSubmission struct {
 	Successes int               `json:"successes,omitempty"`
 	Warnings  metricsSeverity   `json:"warns,omitempty"`
 	Failures  metricsSeverity   `json:"fails,omitempty"`
+	Coverage  float64           `json:"coverage,omitempty"`
+	Healthy   bool              `json:"healthy"`
+	Version   string            `json:"version,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
 	Details   []jsonCheckResult `json:"details,omitempty"`
+
+	// the fields below were added later and are omitted unless set, as metrics
+	// servers may reject unknown fields. The exceptions are only set when there
+	// are some, and the git context only with METRICS_CONTEXT.
+	Exceptions  *metricsSeverity `json:"exceptions,omitempty"`
+	Repository  string           `json:"repository,omitempty"`
+	SHA         string           `json:"sha,omitempty"`
+	Ref         string           `json:"ref,omitempty"`
+	Branch      string           `json:"branch,omitempty"`
+	PullRequest int              `json:"pullRequest,omitempty"`
+}
+
+type metricsSeverity struct {
+	Count     int      `json:"count,omitempty"`
+	PolicyIDs []string `json:"policyIDs,omitempty"`
+}
+
+// configError is returned when the action has been misconfigured.
+type configError struct {
+	err error
+}
+
+func (e *configError) Error() string { return e.err.Error() }
+func (e *configError) Unwrap() error { return e.err }
+
+// conftestError is returned when conftest itself could not be run successfully.
+type conftestError struct {
+	err error
+}
+
+func (e *conftestError) Error() string { return e.err.Error() }
+func (e *conftestError) Unwrap() error { return e.err }
+
+// executionError is returned when conftest did not produce results, such as
+// when the policies could not be loaded, and holds the full output of conftest.
+type executionError struct {
+	output string
+	err    error
+}
+
+func (e *executionError) Error() string {
+	return fmt.Sprintf("conftest execution error (%s), the output was not valid JSON:\n%s", e.err, e.output)
+}
+
+func (e *executionError) Unwrap() error { return e.err }
+
+// pullError is returned when the policies could not be pulled.
+type pullError struct {
+	err error
+}
+
+func (e *pullError) Error() string { return e.err.Error() }
+func (e *pullError) Unwrap() error { return e.err }
+
+// violationError is returned when the policies identified violations.
+type violationError struct {
+	fails int
+
+	// warns is set instead of fails when the run failed because of warnings
+	// with FAIL_ON_WARN
+	warns int
+}
+
+func (e *violationError) Error() string {
+	if e.fails == 0 && e.warns > 0 {
+		return fmt.Sprintf("%d warnings were found (fail-on-warn enabled)", e.warns)
+	}
+
+	return fmt.Sprintf("%d policy violations were found", e.fails)
+}
+
+// multiError collects the errors of operations that are independent of each
+// other.
+type multiError []error
+
+func (e multiError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// violation is a single failure or warning reported by conftest.
+type violation struct {
+	Filename string
+	Message  string
+	PolicyID string
+	Severity string
+
+	// Remediation is a command fixing the violation, only set with
+	// SHOW_REMEDIATION
+	Remediation string
+}
+
+// commentSummary is the number of checks evaluated by conftest.
+type commentSummary struct {
+	Checks     int
+	Files      int
+	Fails      int
+	Warns      int
+	Exceptions int
+}
+
+// severityGroup is a set of violations with the same severity.
+type severityGroup struct {
+	Name       string
+	Violations []string
+}
+
+func (v violation) String() string {
+	return fmt.Sprintf("%s - %s", v.Filename, v.Message)
+}
+
+// httpError is returned when a remote server responds with a non-2xx status.
+type httpError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *httpError) Error() string {
+	return fmt.Sprintf("remote server error: status %d: %s", e.StatusCode, e.Body)
+}
+
+const commentTemplate = `**Conftest has identified issues with your resources**
+{{ with .Summary }}
+Evaluated {{ .Checks }} policies across {{ .Files }} files; {{ .Fails }} failing, {{ .Warns }} warning{{ if .Exceptions }}, {{ .Exceptions }} excepted{{ end }}.
+{{ end }}{{ if .Severities }}{{ range .Severities }}
+**{{ .Name }}**
+
+{{ range .Violations }}* {{ indent . }}
+{{ end }}{{ end }}{{ else }}{{ if .Fails }}
+The following policy violations were identified. These are blocking and must be remediated before proceeding.
+
+{{ range .Fails }}* {{ indent . }}
+{{ end }}{{ end }}{{ if .Warns }}
+The following warnings were identified. These are issues that indicate the resources are not following best practices.
+
+{{ range .Warns }}* {{ indent . }}
+{{ end }}{{ end }}{{ end }}{{ if .PolicyErrors }}
+The following policy errors were identified. These are bugs in the policies rather than issues with the resources.
+
+{{ range .PolicyErrors }}* {{ indent . }}
+{{ end }}{{ end }}{{ if .Exceptions }}
+<details>
+<summary>Exceptions applied</summary>
+
+The following policies were not enforced because an exception applied to them.
+
+{{ range .Exceptions }}* {{ indent . }}
+{{ end }}
+</details>
+{{ end }}
+{{ if .DocsURL }}For more information, see the [policy documentation]({{ .DocsURL }}).
+{{end}}{{ if .GistURL }}The full report is archived in [this gist]({{ .GistURL }}).
+{{end}}{{ if .Version }}
+<sub>generated by action-conftest {{ .Version }}</sub>
+{{end}}{{ if .Marker }}<!-- {{ .Marker }} -->
+{{end}}`
+
+// problemMatcher matches the lines written by printProblems.
+const problemMatcher = `{
+  "problemMatcher": [
+    {
+      "owner": "conftest",
+      "pattern": [
+        {
+          "regexp": "^conftest (error|warning) ([^:]+): (.*)$",
+          "severity": 1,
+          "file": 2,
+          "message": 3
+        }
+      ]
+    }
+  ]
+}
+`
+
+// defaultHTTPConcurrency is the number of independent HTTP requests, such as
+// submitting metrics to multiple endpoints, that are made at the same time.
+const defaultHTTPConcurrency = 4
+
+// defaultPolicyIDKey is the key the policy ID is read from when no other key
+// applies.
+const defaultPolicyIDKey = "policyID"
+
+// reviewEvents are the review events that can be submitted for runs without
+// failures.
+var reviewEvents = []string{"COMMENT", "APPROVE"}
+
+// defaultGitHubAPIURL is used when the runner does not set GITHUB_API_URL.
+const defaultGitHubAPIURL = "https://api.github.com"
+
+// severityOrder is the order severities from the metadata are listed in. Other
+// severities are listed after these, followed by violations without a severity
+// grouped by whether conftest reported them as a failure or a warning.
+var severityOrder = []string{"critical", "high", "medium", "low", "info"}
+
+// defaultCommentMarker is embedded in the comments as a hidden HTML comment so
+// that they can be identified.
+const defaultCommentMarker = "conftest-action"
+
+// version is the version of the action, set at build time with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
+// commentRetries is the number of times submitting the PR comment is retried
+// after a server error when COMMENT_RETRIES is not set, waiting
+// commentRetryDelay before the first retry.
+var (
+	commentRetries    = 3
+	commentRetryDelay = 2 * time.Second
+)
+
+// defaultPullRetries and defaultPullRetryDelay are used when PULL_RETRIES and
+// PULL_RETRY_DELAY are not set. The delay doubles after each attempt.
+const (
+	defaultPullRetries    = 3
+	defaultPullRetryDelay = 2 * time.Second
+)
+
+// containerWorkspace is where the workspace is mounted when running conftest
+// in a container. containerEnvVars are passed through to the container.
+const containerWorkspace = "/project"
+
+// actionWorkspace is where GitHub mounts the workspace in the container of a
+// docker action.
+const actionWorkspace = "/github/workspace"
+
+var containerEnvVars = []string{"GOOGLE_APPLICATION_CREDENTIALS", "DOCKER_CONFIG"}
+
+// conftestSubcommands are the conftest subcommands that produce results the
+// action is able to report on.
+var conftestSubcommands = []string{"test", "verify"}
+
+var conftestFlags = []string{"COMBINE", "POLICY", "ALL_NAMESPACES", "NAMESPACE", "DATA", "IGNORE", "STRICT", "SHOW_BUILTIN_ERRORS"}
+
+// repeatableFlags can be supplied multiple times by separating the values with
+// newlines. The flags are passed to conftest in the order they were supplied.
+var repeatableFlags = []string{"NAMESPACE", "DATA"}
+
+// flagConflicts are pairs of conftest flags that cannot be supplied together.
+var flagConflicts = []struct {
+	flags  [2]string
+	reason string
+}{
+	{[2]string{"--all-namespaces", "--namespace"}, "all-namespaces already tests every namespace, set namespace or set all-namespaces to false to test specific namespaces"},
+}
+
+func main() {
+	rand.Seed(time.Now().UnixNano())
+
+	if isVersionMode(os.Args[1:]) {
+		if err := printVersion(os.Stdout); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	err := run()
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	os.Exit(exitCode(err))
+}
+
+func run() error {
+	// pull-only runs prime the policy directory for later jobs, so there is
+	// nothing to test
+	pullOnly := envEnabled("PULL_ONLY")
+	if pullOnly && os.Getenv("PULL_URL") == "" {
+		return &configError{fmt.Errorf("pull-url must be specified if pull-only is set")}
+	}
+
+	if !pullOnly && os.Getenv("FILES") == "" && os.Getenv("INPUT_B64") == "" && os.Getenv("RESULTS_FILE") == "" && getRenderCommand() == nil {
+		return &configError{fmt.Errorf("at least one file to test must be supplied")}
+	}
+
+	if envEnabled("HELM") && envEnabled("KUSTOMIZE") {
+		return &configError{fmt.Errorf("helm and kustomize cannot be used together")}
+	}
+
+	if _, _, err := getInputFromEnv(); err != nil {
+		return &configError{err}
+	}
+
+	extraArgs, err := getExtraArgsFromEnv()
+	if err != nil {
+		return &configError{err}
+	}
+
+	if err := validateIgnore(os.Getenv("IGNORE")); err != nil {
+		return &configError{err}
+	}
+
+	// the globs are only expanded once, and the files passed to everything that
+	// needs them
+	files, unmatched, err := expandGlobs(getFilesFromEnv())
+	if err != nil {
+		return &configError{err}
+	}
+	for _, pattern := range unmatched {
+		if !envEnabled("GLOB_ALLOW_EMPTY") {
+			return &configError{fmt.Errorf("%s did not match any files, set glob-allow-empty to allow this", pattern)}
+		}
+		fmt.Printf("::warning::%s did not match any files\n", pattern)
+	}
+	testedFiles := files
+	if getRenderCommand() != nil {
+		testedFiles = []string{"-"}
+	}
+	if err := validateFlags(append(getFlagsFromEnv(), extraArgs...), testedFiles); err != nil {
+		return &configError{fmt.Errorf("validating flags: %w", err)}
+	}
+
+	if _, err := getSubcommandFromEnv(); err != nil {
+		return &configError{err}
+	}
+
+	if _, err := getReviewEventFromEnv(); err != nil {
+		return &configError{err}
+	}
+
+	if _, err := getWebhookTemplate(); err != nil {
+		return &configError{err}
+	}
+
+	if os.Getenv("COMMENT_TEMPLATE") != "" && os.Getenv("COMMENT_TEMPLATE_FILE") != "" {
+		return &configError{fmt.Errorf("comment-template and comment-template-file cannot be used together")}
+	}
+	if text, err := getCommentTemplate(); err != nil {
+		return &configError{err}
+	} else if _, err := parseCommentTemplate(text); err != nil {
+		return &configError{fmt.Errorf("invalid comment template: %w", err)}
+	}
+
+	if envEnabled("DELETE_RESOLVED_COMMENT") && envEnabled("COMMENT_ON_SUCCESS") {
+		return &configError{fmt.Errorf("delete-resolved-comment and comment-on-success cannot be used together")}
+	}
+
+	// the notes of a GitLab merge request cannot be found by their marker, so
+	// these options would silently do nothing
+	if !getCommentProvider().CanUpdate {
+		for _, v := range []string{"UPDATE_COMMENT", "DELETE_RESOLVED_COMMENT", "COMMENT_ON_SUCCESS", "COMMENT_ONLY_ON_CHANGE"} {
+			if envEnabled(v) {
+				return &configError{fmt.Errorf("%s is not supported with gitlab-mr-url", strings.ToLower(strings.ReplaceAll(v, "_", "-")))}
+			}
+		}
+	}
+
+	// the native and the parsed JUnit reports would overwrite each other
+	if junitFile := os.Getenv("JUNIT_FILE"); junitFile != "" && filepath.Clean(junitFile) == filepath.Clean(os.Getenv("CONFTEST_JUNIT_FILE")) {
+		return &configError{fmt.Errorf("junit-file and conftest-junit-file cannot be the same file")}
+	}
+
+	if _, err := getDurationFromEnv("TEST_TIMEOUT", 0); err != nil {
+		return &configError{err}
+	}
+
+	if _, err := getRetryPolicy("COMMENT", commentRetries, commentRetryDelay); err != nil {
+		return &configError{err}
+	}
+
+	httpPolicy, err := getRetryPolicy("", 0, defaultHTTPRetryDelay)
+	if err != nil {
+		return &configError{err}
+	}
+
+	metricsPolicy, err := getRetryPolicy("METRICS", defaultMetricsRetries, defaultMetricsRetryDelay)
+	if err != nil {
+		return &configError{err}
+	}
+
+	metricsHeaders, err := parseHeaders(getListFromEnv("METRICS_HEADERS"))
+	if err != nil {
+		return &configError{fmt.Errorf("parsing metrics headers: %w", err)}
+	}
+
+	if _, err := getDurationFromEnv("COMMENT_TIMEOUT", 0); err != nil {
+		return &configError{err}
+	}
+
+	if _, err := getIntFromEnv("PULL_RETRIES", defaultPullRetries); err != nil {
+		return &configError{err}
+	}
+
+	if _, err := getDurationFromEnv("PULL_RETRY_DELAY", defaultPullRetryDelay); err != nil {
+		return &configError{err}
+	}
+
+	if code, err := getIntFromEnv("PULL_FAILURE_EXIT_CODE", 1); err != nil {
+		return &configError{err}
+	} else if code < 1 || code > 255 {
+		return &configError{fmt.Errorf("PULL_FAILURE_EXIT_CODE must be between 1 and 255, as 0 would pass the build")}
+	}
+
+	baseFails, err := getIntFromEnv("BASE_FAIL_COUNT", -1)
+	if err != nil {
+		return &configError{err}
+	}
+
+	minSuccesses, err := getIntFromEnv("MIN_SUCCESSES", 0)
+	if err != nil {
+		return &configError{err}
+	}
+
+	targets, err := getPullTargets()
+	if err != nil {
+		return &configError{fmt.Errorf("get full pull url: %w", err)}
+	}
+
+	// the conftest bundled with the action is known to be supported, so only a
+	// binary or image given by the user is checked, before it is first run
+	custom := os.Getenv("CONFTEST_BIN") != "" || os.Getenv("CONFTEST_IMAGE") != ""
+	if custom && (len(targets) > 0 || len(getListFromEnv("RESULTS_FILE")) == 0) {
+		if err := checkConftestVersion(os.Stdout); err != nil {
+			return &conftestError{err}
+		}
+	}
+
+	if err := pullPolicies(targets); err != nil {
+		return &pullError{fmt.Errorf("runnning conftest pull: %w", err)}
+	}
+
+	if pullOnly {
+		fmt.Println("Pulled the policies, skipping the tests as pull-only is set")
+		return nil
+	}
+
+	var results []jsonCheckResult
+	var policyErrors []string
+	if resultsFiles := getListFromEnv("RESULTS_FILE"); len(resultsFiles) > 0 {
+		// the results of earlier conftest runs are reported instead of testing
+		// the files again
+		results, err = readResultsFiles(resultsFiles)
+		if err != nil {
+			return &configError{fmt.Errorf("reading results files: %w", err)}
+		}
+	} else {
+		results, policyErrors, err = runConftestTest(files)
+		if err != nil {
+			return &conftestError{fmt.Errorf("running conftest: %w", err)}
+		}
+	}
+
+	results = waiveFiles(results, getListFromEnv("WAIVED_FILES"))
+
+	waivers, err := parseWaivers(getListFromEnv("WAIVED_POLICIES"))
+	if err != nil {
+		return &configError{fmt.Errorf("parsing waived policies: %w", err)}
+	}
+	results = waivePolicies(results, waivers, os.Getenv("POLICY_ID_KEY"), time.Now())
+
+	if tag := os.Getenv("FILTER_TAG"); tag != "" {
+		results = filterByTag(results, tag)
+	}
+
+	if junitFile := os.Getenv("CONFTEST_JUNIT_FILE"); junitFile != "" {
+		if err := runConftestJUnit(junitFile, files); err != nil {
+			return &conftestError{fmt.Errorf("running conftest junit output: %w", err)}
+		}
+	}
+
+	if junitFile := os.Getenv("JUNIT_FILE"); junitFile != "" {
+		if err := writeJUnit(junitFile, results); err != nil {
+			return fmt.Errorf("writing junit file: %w", err)
+		}
+	}
+
+	// local runs never talk to GitHub or the metrics server
+	local := envEnabled("LOCAL")
+	dryRun := envEnabled("DRY_RUN")
+	metricsURLs := getListFromEnv("METRICS_URL")
+	policyIDKey := os.Getenv("POLICY_ID_KEY")
+	severityKey := os.Getenv("SEVERITY_KEY")
+	showRemediation := envEnabled("SHOW_REMEDIATION")
+
+	// combined runs report a single result, so attribute violations back to the
+	// input files where the policy gives a hint
+	var combinedFiles []string
+	if envEnabled("COMBINE") {
+		combinedFiles = files
+	}
+
+	var policiesWithFails, policiesWithWarns, policiesWithExceptions []string
+	var fails, warns, untagged []violation
+	var exceptions []string
+	var successes int
+	for _, result := range results {
+		if envEnabled("PROGRESS") {
+			printProgress(os.Stdout, result)
+		}
+
+		successes += len(result.Successes)
+
+		for _, exception := range result.Exceptions {
+			exceptions = append(exceptions, fmt.Sprintf("%s - %s", result.Filename, exception.Message))
+			policyID, err := getPolicyIDFromMetadata(exception.Metadata, resolvePolicyIDKey(policyIDKey, result.Namespace))
+			if err == nil && !contains(policiesWithExceptions, policyID) {
+				policiesWithExceptions = append(policiesWithExceptions, policyID)
+			}
+		}
+
+		for _, fail := range result.Failures {
+			policyID, err := getPolicyIDFromMetadata(fail.Metadata, resolvePolicyIDKey(policyIDKey, result.Namespace))
+			fails = append(fails, violation{
+				Filename: attributeFilename(result.Filename, fail, combinedFiles),
+				Message:  fail.Message,
+				PolicyID: policyID,
+				Severity: getSeverityFromMetadata(fail.Metadata, severityKey),
+
+				Remediation: getRemediationFromMetadata(fail.Metadata, showRemediation),
+			})
+			if err != nil {
+				untagged = append(untagged, fails[len(fails)-1])
+				continue
+			}
+			if !contains(policiesWithFails, policyID) {
+				policiesWithFails = append(policiesWithFails, policyID)
+			}
+		}
+
+		for _, warn := range result.Warnings {
+			policyID, err := getPolicyIDFromMetadata(warn.Metadata, resolvePolicyIDKey(policyIDKey, result.Namespace))
+			warns = append(warns, violation{
+				Filename: attributeFilename(result.Filename, warn, combinedFiles),
+				Message:  warn.Message,
+				PolicyID: policyID,
+				Severity: getSeverityFromMetadata(warn.Metadata, severityKey),
+
+				Remediation: getRemediationFromMetadata(warn.Metadata, showRemediation),
+			})
+			if err != nil {
+				untagged = append(untagged, warns[len(warns)-1])
+				continue
+			}
+			if !contains(policiesWithWarns, policyID) {
+				policiesWithWarns = append(policiesWithWarns, policyID)
+			}
+		}
+	}
+
+	// the counts are set before any failure is returned, so that later steps can
+	// branch on them even when the job fails
+	if err := setCountOutputs(successes, len(fails), len(warns)); err != nil {
+		return err
+	}
+
+	// guard against a passing build when the policies were not loaded. The run
+	// only fails once the results have been reported, so that there is a
+	// report to look into.
+	var resultErr error
+	if successes < minSuccesses {
+		resultErr = fmt.Errorf("expected at least %d passing checks but saw %d — policies may not have loaded", minSuccesses, successes)
+	}
+
+	// the trace is only useful to policy authors when a policy fired, and is
+	// not available for the results of earlier runs
+	if envEnabled("TRACE") && len(fails) > 0 && len(getListFromEnv("RESULTS_FILE")) == 0 {
+		if err := runConftestTrace(os.Stdout, files); err != nil {
+			fmt.Printf("tracing conftest: %s\n", err)
+		}
+	}
+
+	// strict metadata fails the run, even with NO_FAIL, so that policy authors
+	// always tag their rules
+	if envEnabled("STRICT_METADATA") && len(untagged) > 0 && resultErr == nil {
+		resultErr = fmt.Errorf("policy ID missing from the metadata of %d violations: %s", len(untagged), strings.Join(formatViolations(untagged), "; "))
+	}
+
+	if envEnabled("PROBLEM_MATCHER") {
+		if err := registerProblemMatcher(os.Stdout, getTempDir()); err != nil {
+			return fmt.Errorf("registering problem matcher: %w", err)
+		}
+		printProblems(os.Stdout, results)
+	}
+
+	if os.Getenv("ANNOTATION_MODE") == "summary" {
+		printSummaryAnnotation(os.Stdout, len(fails), len(warns))
+	}
+
+	if envEnabled("ANNOTATIONS") {
+		printAnnotations(os.Stdout, fails, warns)
+	}
+
+	if annotationsFile := os.Getenv("ANNOTATIONS_FILE"); annotationsFile != "" {
+		if err := writeAnnotations(annotationsFile, fails, warns); err != nil {
+			return fmt.Errorf("writing annotations file: %w", err)
+		}
+	}
+
+	if sarifFile := os.Getenv("SARIF_FILE"); sarifFile != "" {
+		if err := writeSARIF(sarifFile, getSARIF(fails, warns, os.Getenv("DOCS_URL"))); err != nil {
+			return fmt.Errorf("writing sarif file: %w", err)
+		}
+	}
+
+	if attestationFile := os.Getenv("ATTESTATION_FILE"); attestationFile != "" {
+		passed := !exceedsBaseFails(len(fails), baseFails) && !(envEnabled("FAIL_ON_WARN") && len(warns) > 0)
+		statement, err := getAttestation(files, successes, len(fails), len(warns), passed)
+		if err != nil {
+			return fmt.Errorf("creating attestation: %w", err)
+		}
+		if err := writeAttestation(attestationFile, statement); err != nil {
+			return fmt.Errorf("writing attestation file: %w", err)
+		}
+	}
+
+	if envEnabled("DETECT_DEAD_POLICIES") {
+		dead := detectDeadPolicies(getListFromEnv("EXPECTED_POLICIES"), append(policiesWithFails, policiesWithWarns...))
+		if len(dead) > 0 {
+			fmt.Printf("The following policies did not report any violations: %s\n", strings.Join(dead, ", "))
+		}
+		if err := setOutput("dead-policies", strings.Join(dead, ",")); err != nil {
+			return fmt.Errorf("setting dead policies output: %w", err)
+		}
+	}
+
+	coverage := getCoverage(successes, len(fails), len(warns))
+	if err := setOutput("coverage", fmt.Sprintf("%.2f", coverage)); err != nil {
+		return fmt.Errorf("setting coverage output: %w", err)
+	}
+
+	oneline := getOneline(successes, len(fails), len(warns), os.Getenv("GITHUB_REPOSITORY"), os.Getenv("GITHUB_SHA"))
+	if err := setOutput("oneline", oneline); err != nil {
+		return fmt.Errorf("setting oneline output: %w", err)
+	}
+	if envEnabled("ONELINE") {
+		fmt.Println(oneline)
+	}
+
+	// attempt to submit metrics, but do not fail the CI job if there are errors
+	metricsFile := os.Getenv("METRICS_FILE")
+	skipMetrics := local || (envEnabled("METRICS_ONLY_ON_VIOLATIONS") && len(fails) == 0 && len(warns) == 0)
+	if (len(metricsURLs) > 0 || metricsFile != "") && !skipMetrics {
+		sourceID := os.Getenv("METRICS_SOURCE")
+		if sourceID == "" {
+			return &configError{fmt.Errorf("metrics-source must be specified if metrics-url or metrics-file is set")}
+		}
+
+		maxWarnings, err := getIntFromEnv("HEALTHY_MAX_WARNINGS", -1)
+		if err != nil {
+			return &configError{fmt.Errorf("get healthy max warnings: %w", err)}
+		}
+
+		metrics := metricsSubmission{
+			SourceID:  sourceID,
+			Successes: successes,
+			Failures: metricsSeverity{
+				Count:     len(fails),
+				PolicyIDs: policiesWithFails,
+			},
+			Warnings: metricsSeverity{
+				Count:     len(warns),
+				PolicyIDs: policiesWithWarns,
+			},
+			Coverage: coverage,
+			Healthy:  isHealthy(len(fails), len(warns), maxWarnings),
+			Version:  getVersion(),
+		}
+		if len(exceptions) > 0 {
+			metrics.Exceptions = &metricsSeverity{
+				Count:     len(exceptions),
+				PolicyIDs: policiesWithExceptions,
+			}
+		}
+		if envEnabled("METRICS_DETAILS") {
+			metrics.Details = results
+		}
+		if envEnabled("METRICS_CONTEXT") {
+			setMetricsContext(&metrics, getRunContext())
+		}
+
+		labels, err := getMetricsLabels()
+		if err != nil {
+			return &configError{fmt.Errorf("parsing metrics labels: %w", err)}
+		}
+		metrics.Labels = labels
+		fieldMap, err := parseKeyValues(os.Getenv("METRICS_FIELD_MAP"))
+		if err != nil {
+			return &configError{fmt.Errorf("parsing metrics field map: %w", err)}
+		}
+
+		metricsJSON, err := marshalMetrics(metrics, fieldMap)
+		if err != nil {
+			return fmt.Errorf("marshal metrics json: %w", err)
+		}
+
+		if metricsFile != "" {
+			if err := appendMetrics(metricsFile, metricsJSON); err != nil {
+				fmt.Printf("writing metrics file: %s\n", err)
+			}
+		}
+
+		var metricsToken string
+		if os.Getenv("METRICS_TOKEN") != "" {
+			metricsToken = fmt.Sprintf("Bearer %s", os.Getenv("METRICS_TOKEN"))
+		}
+		// the token takes precedence over an Authorization header in
+		// METRICS_HEADERS, so that a request never has two
+		headers := http.Header{}
+		for k := range metricsHeaders {
+			headers.Set(k, metricsHeaders.Get(k))
+		}
+		if metricsToken != "" {
+			headers.Set("Authorization", metricsToken)
+		}
+
+		concurrency, err := getIntFromEnv("HTTP_CONCURRENCY", defaultHTTPConcurrency)
+		if err != nil {
+			return &configError{fmt.Errorf("get http concurrency: %w", err)}
+		}
+
+		var tasks []func() error
+		for _, metricsURL := range metricsURLs {
+			metricsURL := metricsURL
+			if dryRun {
+				printDryRun(os.Stdout, "metrics", metricsURL, metricsJSON)
+				continue
+			}
+			tasks = append(tasks, func() error {
+				if err := submitPostWithHeaders(metricsURL, metricsJSON, headers, metricsPolicy); err != nil {
+					return fmt.Errorf("%s: %w", metricsURL, err)
+				}
+				fmt.Printf("submitted metrics to %s\n", metricsURL)
+				return nil
+			})
+		}
+
+		if err := runConcurrently(concurrency, tasks); err != nil {
+			fmt.Printf("submitting metrics: %s\n", err)
+		}
+	}
+
+	// attempt to post a datadog event, but do not fail the CI job if there are
+	// errors
+	if apiKey := os.Getenv("DATADOG_API_KEY"); apiKey != "" && !local {
+		event := getDatadogEvent(successes, len(fails), len(warns), os.Getenv("GITHUB_REPOSITORY"), getBranch())
+		eventsURL := getDatadogEventsURL(os.Getenv("DATADOG_SITE"))
+		if dryRun {
+			printDryRunJSON(os.Stdout, "datadog event", eventsURL, event)
+		} else if err := submitDatadogEvent(eventsURL, event, apiKey, httpPolicy); err != nil {
+			fmt.Printf("submitting datadog event: %s\n", err)
+		}
+	}
+
+	// attempt to notify slack, but do not fail the CI job if there are errors
+	slackURL := os.Getenv("SLACK_WEBHOOK_URL")
+	if slackURL != "" && !local && (len(fails) > 0 || (envEnabled("FAIL_ON_WARN") && len(warns) > 0)) {
+		message := getSlackMessage(fails, warns, getRunContext())
+		if dryRun {
+			printDryRunJSON(os.Stdout, "slack notification", slackURL, message)
+		} else if err := submitSlackMessage(slackURL, message, httpPolicy); err != nil {
+			fmt.Printf("submitting slack notification: %s\n", err)
+		}
+	}
+
+	// attempt to notify the webhook, but do not fail the CI job if there are
+	// errors
+	if webhookURL := os.Getenv("WEBHOOK_URL"); webhookURL != "" && !local {
+		d := webhookData{
+			Successes:  successes,
+			Failures:   len(fails),
+			Warnings:   len(warns),
+			Fails:      fails,
+			Warns:      warns,
+			Results:    results,
+			Repository: os.Getenv("GITHUB_REPOSITORY"),
+			SHA:        os.Getenv("GITHUB_SHA"),
+			Branch:     getBranch(),
+			Oneline:    oneline,
+		}
+		if dryRun {
+			body, err := renderWebhook(d)
+			if err != nil {
+				fmt.Printf("rendering webhook: %s\n", err)
+			} else {
+				printDryRun(os.Stdout, "webhook", webhookURL, body)
+			}
+		} else if err := submitWebhook(webhookURL, d, httpPolicy); err != nil {
+			fmt.Printf("submitting webhook: %s\n", err)
+		}
+	}
+
+	if local {
+		printSummary(os.Stdout, successes, len(fails), len(warns))
+	}
+
+	// the job summary is written regardless of ADD_COMMENT, so that runs outside
+	// of pull requests still surface the results
+	summary := renderJobSummary(successes, fails, warns)
+	if envEnabled("STEP_SUMMARY_TABLE") {
+		summary = renderTable(fails, warns)
+	}
+	if err := writeStepSummary(summary); err != nil {
+		return fmt.Errorf("writing step summary: %w", err)
+	}
+
+	if len(fails) == 0 && len(warns) == 0 && len(policyErrors) == 0 {
+		fmt.Println("No policy violations or warnings were identified.")
+
+		// a run that is about to fail must not resolve the comments or
+		// approve the pull request
+		if resultErr != nil {
+			return resultErr
+		}
+		if !local && !dryRun && envEnabled("ADD_COMMENT") && envEnabled("UPDATE_COMMENT") {
+			if err := resolveComments(getCommentProvider()); err != nil {
+				if strings.ToLower(os.Getenv("COMMENT_REQUIRED")) != "false" {
+					return fmt.Errorf("resolving comment: %w", err)
+				}
+				fmt.Printf("resolving comment: %s\n", err)
+			}
+		}
+		if !local && !dryRun {
+			body := fmt.Sprintf("**Conftest did not identify any issues with your resources**\n<!-- %s -->\n", getCommentMarker())
+			if err := postReview([]byte(body), 0); err != nil {
+				return fmt.Errorf("submitting review: %w", err)
+			}
+		}
+		return nil
+	}
+
+	d := commentData{Fails: formatViolations(fails), Warns: formatViolations(warns), PolicyErrors: policyErrors, Successes: successes, Version: getVersion()}
+	if severityKey != "" {
+		d.Severities = groupBySeverity(fails, warns, formatViolations)
+	}
+	if envEnabled("SHOW_EXCEPTIONS") {
+		d.Exceptions = exceptions
+	}
+	if envEnabled("SHOW_SUMMARY") {
+		d.Summary = &commentSummary{
+			Checks:     successes + len(fails) + len(warns),
+			Files:      len(results),
+			Fails:      len(fails),
+			Warns:      len(warns),
+			Exceptions: len(exceptions),
+		}
+	}
+	if os.Getenv("DOCS_URL") != "" {
+		d.DocsURL = os.Getenv("DOCS_URL")
+	}
+
+	// ensure the results are written to the CI logs, coalescing violations that
+	// are repeated across many files so that the log remains readable
+	logData := d
+	logData.Fails, logData.Warns = coalesceViolations(fails), coalesceViolations(warns)
+	if severityKey != "" {
+		logData.Severities = groupBySeverity(fails, warns, coalesceViolations)
+	}
+	logOutput, err := renderTemplate(logData)
+	if err != nil {
+		return fmt.Errorf("rendering log template: %w", err)
+	}
+	fmt.Println(string(logOutput))
+
+	// archive the full report in a gist, linking to it from the comment. A
+	// failure to create the gist does not fail the CI job.
+	if envEnabled("GIST") && !local {
+		report, err := renderTemplate(d)
+		if err != nil {
+			return fmt.Errorf("rendering gist report: %w", err)
+		}
+
+		apiURL := os.Getenv("GITHUB_API_URL")
+		if apiURL == "" {
+			apiURL = defaultGitHubAPIURL
+		}
+
+		if dryRun {
+			gist, err := getGistJSON(report, results)
+			if err != nil {
+				return err
+			}
+			printDryRun(os.Stdout, "gist", getGistsURL(apiURL), gist)
+		} else if gistURL, err := createGist(apiURL, report, results, fmt.Sprintf("token %s", os.Getenv("GITHUB_TOKEN"))); err != nil {
+			fmt.Printf("creating gist: %s\n", err)
+		} else {
+			d.GistURL = gistURL
+		}
+	}
+
+	if envEnabled("ADD_COMMENT") && !local {
+		// the comment is required unless explicitly disabled, so that existing
+		// workflows keep failing when the results cannot be posted
+		commentRequired := strings.ToLower(os.Getenv("COMMENT_REQUIRED")) != "false"
+		for _, c := range getComments(d) {
+			t, err := renderTemplate(c)
+			if err != nil {
+				return fmt.Errorf("rendering template: %w", err)
+			}
+
+			ghComment, err := getCommentJSON(t)
+			if err != nil {
+				return fmt.Errorf("get comment json: %w", err)
+			}
+
+			if dryRun {
+				printDryRun(os.Stdout, "comment", getCommentProvider().URL, ghComment)
+				continue
+			}
+
+			if err := upsertComment(getCommentProvider(), c.Marker, ghComment); err != nil {
+				if commentRequired {
+					return fmt.Errorf("submitting comment: %w", err)
+				}
+				fmt.Printf("submitting comment: %s\n", err)
+			}
+		}
+	}
+
+	if !local && !dryRun {
+		review := d
+		review.Marker = getCommentMarker()
+		body, err := renderTemplate(review)
+		if err != nil {
+			return fmt.Errorf("rendering review template: %w", err)
+		}
+		if err := postReview(body, len(fails)); err != nil {
+			return fmt.Errorf("submitting review: %w", err)
+		}
+	}
+
+	if resultErr != nil {
+		return resultErr
+	}
+
+	// critical policies fail the run even as warnings, and regardless of
+	// BASE_FAIL_COUNT and NO_FAIL
+	if critical := findCriticalViolations(append(fails, warns...), getListFromEnv("CRITICAL_POLICIES")); len(critical) > 0 {
+		return fmt.Errorf("critical policy violated: %s", strings.Join(formatCriticalViolations(critical), "; "))
+	}
+
+	if exceedsBaseFails(len(fails), baseFails) {
+		return &violationError{fails: len(fails)}
+	}
+	if len(fails) > 0 {
+		fmt.Printf("The %d failures do not exceed the %d failures on the base branch.\n", len(fails), baseFails)
+	}
+
+	if envEnabled("FAIL_ON_WARN") && len(warns) > 0 {
+		return &violationError{warns: len(warns)}
+	}
+
+	return nil
+}
+
+// getGistJSON returns the body of the request creating the gist with the report
+// and the raw results.
+func getGistJSON(report []byte, results []jsonCheckResult) ([]byte, error) {
+	raw, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("marshalling results: %w", err)
+	}
+
+	gist := map[string]interface{}{
+		"description": "Conftest results",
+		"public":      false,
+		"files": map[string]interface{}{
+			"conftest-report.md":    map[string]string{"content": string(report)},
+			"conftest-results.json": map[string]string{"content": string(raw)},
+		},
+	}
+	data, err := json.Marshal(gist)
+	if err != nil {
+		return nil, fmt.Errorf("marshalling gist: %w", err)
+	}
+
+	return data, nil
+}
+
+func getGistsURL(apiURL string) string {
+	return strings.TrimSuffix(apiURL, "/") + "/gists"
+}
+
+// printDryRunJSON is printDryRun for a payload that is sent as JSON.
+func printDryRunJSON(w io.Writer, name, url string, v interface{}) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		fmt.Fprintf(w, "marshalling %s: %s\n", name, err)
+		return
+	}
+
+	printDryRun(w, name, url, payload)
+}
+
+// printDryRun prints the payload that would have been sent to url, instead of
+// sending it.
+func printDryRun(w io.Writer, name, url string, payload []byte) {
+	fmt.Fprintf(w, "::group::dry run: not submitting %s to %s\n%s\n::endgroup::\n", name, url, payload)
+}
+
+// findCriticalViolations returns the violations of the critical policies.
+func findCriticalViolations(violations []violation, critical []string) []violation {
+	var out []violation
+	for _, v := range violations {
+		if v.PolicyID != "" && contains(critical, v.PolicyID) {
+			out = append(out, v)
+		}
+	}
+
+	return out
+}
+
+func formatCriticalViolations(violations []violation) []string {
+	var out []string
+	for _, v := range violations {
+		out = append(out, fmt.Sprintf("%s in %s - %s", v.PolicyID, v.Filename, v.Message))
+	}
+
+	return out
+}
+
+// exceedsBaseFails returns whether the run should fail with the given number of
+// failures. When baseFails is negative there is no base branch to compare with,
+// so any failure fails the run.
+func exceedsBaseFails(fails, baseFails int) bool {
+	if baseFails < 0 {
+		return fails > 0
+	}
+
+	return fails > baseFails
+}
+
+// exitCode returns the exit code for the error returned by run. NO_FAIL only
+// suppresses policy violations, so that problems running conftest or with the
+// configuration of the action are never reported as a passing build. Failing to
+// pull the policies exits with PULL_FAILURE_EXIT_CODE when it is set.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var violationErr *violationError
+	if errors.As(err, &violationErr) && envEnabled("NO_FAIL") {
+		return 0
+	}
+
+	// a failed pull is an infrastructure issue rather than a policy decision,
+	// so it can be given its own exit code
+	var pullErr *pullError
+	if errors.As(err, &pullErr) {
+		if code, err := getIntFromEnv("PULL_FAILURE_EXIT_CODE", 1); err == nil && code > 0 {
+			return code
+		}
+	}
+
+	return 1
+}
+
+// pullTarget is where to pull the policies from, along with any environment
+// variables the pull command needs. The environment is only given to the pull
+// command, so that credentials are not exposed to later steps of the workflow.
+type pullTarget struct {
+	URL string
+	Env []string
+
+	// Dir is the directory the policies are pulled into, the default policy
+	// directory of conftest when empty
+	Dir string
+
+	// BearerToken is sent when downloading the policies from URL, in which case
+	// the policies are downloaded by the action and conftest pulls the local copy
+	BearerToken string
+
+	// tempPaths are removed by cleanup once the pull has completed
+	tempPaths []string
+}
+
+func (p pullTarget) cleanup() {
+	for _, path := range p.tempPaths {
+		os.RemoveAll(path)
+	}
+}
+
+// getPullTargets returns a target for each of the sources in PULL_URL, which
+// may be separated by newlines or commas. When there are multiple sources, each
+// is pulled into its own subdirectory of the policy directory. PULL_SECRET may
+// then hold a secret for each source on separate lines, otherwise the single
+// secret is applied to all sources.
+func getPullTargets() ([]pullTarget, error) {
+	var urls []string
+	for _, u := range strings.FieldsFunc(os.Getenv("PULL_URL"), func(r rune) bool { return r == '\n' || r == ',' }) {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+
+	if len(urls) == 1 {
+		target, err := getFullPullURL(urls[0], os.Getenv("PULL_SECRET"))
+		if err != nil {
+			return nil, err
+		}
+		return []pullTarget{target}, nil
+	}
+
+	policyDir := os.Getenv("POLICY")
+	if policyDir == "" {
+		policyDir = "policy"
+	}
+	secrets := getListFromEnv("PULL_SECRET")
+
+	var targets []pullTarget
+	for i, u := range urls {
+		secret := os.Getenv("PULL_SECRET")
+		if len(secrets) == len(urls) {
+			secret = secrets[i]
+		}
+
+		target, err := getFullPullURL(u, secret)
+		if err != nil {
+			for _, t := range targets {
+				t.cleanup()
+			}
+			return nil, fmt.Errorf("source %d: %w", i+1, err)
+		}
+		target.Dir = filepath.Join(policyDir, fmt.Sprintf("source-%d", i+1))
+		targets = append(targets, target)
+	}
+
+	return targets, nil
+}
+
+// pullPolicies pulls the policies from each of the targets in order, removing
+// the temporary files of every target once done.
+func pullPolicies(targets []pullTarget) error {
+	defer func() {
+		for _, target := range targets {
+			target.cleanup()
+		}
+	}()
+
+	for i := range targets {
+		target := &targets[i]
+		if target.BearerToken != "" {
+			dir, err := ioutil.TempDir(getTempDir(), "policy-download-")
+			if err != nil {
+				return fmt.Errorf("creating download dir: %w", err)
+			}
+			target.tempPaths = append(target.tempPaths, dir)
+
+			local, err := downloadPolicies(target.URL, dir, target.BearerToken)
+			if err != nil {
+				return fmt.Errorf("downloading policies: %w", err)
+			}
+			target.URL = local
+		}
+
+		if err := runConftestPull(target.URL, target.Dir, target.Env, getPullProgress()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// downloadPolicies downloads the policies from pullURL into dir with a bearer
+// token, keeping the name of the file so that conftest can detect archives by
+// their extension. It returns the path of the downloaded file.
+func downloadPolicies(pullURL, dir, token string) (string, error) {
+	u, err := url.Parse(pullURL)
+	if err != nil {
+		return "", fmt.Errorf("parsing url: %w", err)
+	}
+
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		name = "policy"
+	}
+
+	body, err := sendRequest("GET", pullURL, nil, "Bearer "+token, 0)
+	if err != nil {
+		return "", err
+	}
+
+	local := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(local, body, 0600); err != nil {
+		return "", fmt.Errorf("writing policies: %w", err)
+	}
+
+	return local, nil
+}
+
+// getFullPullURL returns the target to pull the policies from pullURL with
+// pullSecret applied.
+func getFullPullURL(pullURL, pullSecret string) (pullTarget, error) {
+	if pullURL == "" {
+		return pullTarget{}, nil
+	}
+
+	pullURLSplit := strings.Split(pullURL, "/")
+	if len(pullURLSplit) == 1 {
+		return pullTarget{}, fmt.Errorf("invalid url: %s", pullURL)
+	}
+
+	if pullSecret == "" {
+		return pullTarget{URL: pullURL}, nil
+	}
+
+	var target pullTarget
+	pullURI := pullURLSplit[0]
+	switch pullURI {
+	case "gcs::https:":
+		f, err := ioutil.TempFile(getTempDir(), "gcs-*.json")
+		if err != nil {
+			return pullTarget{}, fmt.Errorf("creating gcs creds file: %w", err)
+		}
+		target.tempPaths = append(target.tempPaths, f.Name())
+
+		_, err = f.Write([]byte(pullSecret))
+		f.Close()
+		if err != nil {
+			target.cleanup()
+			return pullTarget{}, fmt.Errorf("writing gcs creds: %w", err)
+		}
+		target.Env = append(target.Env, "GOOGLE_APPLICATION_CREDENTIALS="+f.Name())
+
+	case "s3::https:":
+		pullURL = pullURL + "?" + pullSecret
+
+	case "oci:":
+		dockerConfig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(pullSecret))
+		if err != nil {
+			return pullTarget{}, fmt.Errorf("decoding docker config: %w", err)
+		}
+
+		dir, err := ioutil.TempDir(getTempDir(), "docker-config-")
+		if err != nil {
+			return pullTarget{}, fmt.Errorf("creating docker config dir: %w", err)
+		}
+		target.tempPaths = append(target.tempPaths, dir)
+
+		if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), dockerConfig, 0600); err != nil {
+			target.cleanup()
+			return pullTarget{}, fmt.Errorf("writing docker config: %w", err)
+		}
+		target.Env = append(target.Env, "DOCKER_CONFIG="+dir)
+
+	case "https:":
+		switch os.Getenv("PULL_AUTH_SCHEME") {
+		case "", "basic":
+		case "bearer":
+			target.URL = pullURL
+			target.BearerToken = pullSecret
+			return target, nil
+		default:
+			return pullTarget{}, fmt.Errorf("unsupported pull auth scheme %q, must be basic or bearer", os.Getenv("PULL_AUTH_SCHEME"))
+		}
+
+		u, err := url.Parse(pullURL)
+		if err != nil {
+			return pullTarget{}, fmt.Errorf("parsing url: %w", err)
+		}
+		pullURL = "https://" + pullSecret + "@" + u.Host + u.Path
+
+	default:
+		return pullTarget{}, fmt.Errorf("PULL_SECRET not supported with uri: %s", pullURI)
+	}
+
+	target.URL = pullURL
+	return target, nil
+}
+
+// runConftestPull pulls the policies from url into dir, retrying failures other
+// than authentication errors. The output of conftest is streamed to progress
+// line by line as it arrives when progress is not nil.
+func runConftestPull(url, dir string, env []string, progress io.Writer) error {
+	retries, err := getIntFromEnv("PULL_RETRIES", defaultPullRetries)
+	if err != nil {
+		return err
+	}
+	delay, err := getDurationFromEnv("PULL_RETRY_DELAY", defaultPullRetryDelay)
+	if err != nil {
+		return err
+	}
+
+	var stderr string
+	for attempt := 1; attempt <= retries+1; attempt++ {
+		args := []string{"pull", url}
+		if dir != "" {
+			args = []string{"pull", "--policy", dir, url}
+		}
+
+		cmd, err := conftestCommand(context.Background(), args...)
+		if err != nil {
+			return fmt.Errorf("creating conftest command: %w", err)
+		}
+		cmd.Env = append(os.Environ(), env...)
+
+		var out bytes.Buffer
+		cmd.Stderr = &out
+		var stdoutLines, stderrLines *lineWriter
+		if progress != nil {
+			stdoutLines, stderrLines = newLineWriters(progress, "conftest pull: ")
+			cmd.Stdout = stdoutLines
+			cmd.Stderr = io.MultiWriter(&out, stderrLines)
+		}
+		err = cmd.Run()
+		if progress != nil {
+			stdoutLines.Flush()
+			stderrLines.Flush()
+		}
+		if err == nil {
+			return nil
+		}
+		stderr = out.String()
+
+		// retrying cannot fix misconfigured credentials
+		if isAuthError(stderr) {
+			return fmt.Errorf("authentication failed: %s", stderr)
+		}
+
+		if attempt <= retries {
+			fmt.Printf("pulling policies failed (attempt %d of %d), retrying in %s\n", attempt, retries+1, delay)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+
+	return fmt.Errorf("after %d attempts: %s", retries+1, stderr)
+}
+
+// getPullProgress returns where the progress of pulling the policies is
+// written, which is the log with PROGRESS or when the runner has debug logging
+// enabled, and nil otherwise.
+func getPullProgress() io.Writer {
+	if envEnabled("PROGRESS") || os.Getenv("RUNNER_DEBUG") == "1" {
+		return os.Stdout
+	}
+
+	return nil
+}
+
+// lineWriter writes each complete line written to it to w with a prefix, so
+// that the output of a command can be streamed as it arrives. Each stream of a
+// command needs a lineWriter of its own, so that partial lines of the streams
+// are not joined.
+type lineWriter struct {
+	w      io.Writer
+	prefix string
+
+	// mu is shared by the writers of the streams of a command, so that their
+	// lines are written to w one at a time
+	mu      *sync.Mutex
+	partial []byte
+}
+
+// newLineWriters returns the line writers for the stdout and stderr of a
+// command, writing to the same w.
+func newLineWriters(w io.Writer, prefix string) (*lineWriter, *lineWriter) {
+	mu := &sync.Mutex{}
+	return &lineWriter{w: w, prefix: prefix, mu: mu}, &lineWriter{w: w, prefix: prefix, mu: mu}
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.partial = append(l.partial, p...)
+	for {
+		i := bytes.IndexByte(l.partial, '\n')
+		if i < 0 {
+			break
+		}
+		if _, err := fmt.Fprintf(l.w, "%s%s\n", l.prefix, l.partial[:i]); err != nil {
+			return 0, err
+		}
+		l.partial = l.partial[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// Flush writes the last line when it did not end with a newline.
+func (l *lineWriter) Flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.partial) > 0 {
+		fmt.Fprintf(l.w, "%s%s\n", l.prefix, l.partial)
+		l.partial = nil
+	}
+}
+
+// authErrorPattern matches the status of a response rejecting the credentials,
+// such as status 401 or 403 Forbidden, rather than any 401 or 403 in the
+// output, which may be part of a digest.
+var authErrorPattern = regexp.MustCompile(`(?i)\b(status( code)?:? 40[13]|unauthorized|forbidden)\b`)
+
+// isAuthError returns whether the output of conftest pull reports that the
+// remote rejected the credentials.
+func isAuthError(out string) bool {
+	return authErrorPattern.MatchString(out)
+}
+
+func runConftestTest(files []string) ([]jsonCheckResult, []string, error) {
+	timeout, err := getDurationFromEnv("TEST_TIMEOUT", 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// with a trace file, the trace is written to stderr and kept apart from the
+	// results on stdout
+	traceFile := os.Getenv("TRACE_FILE")
+	var flags []string
+	if traceFile != "" {
+		flags = append(flags, "--trace")
+	}
+
+	cmd, paths, cleanup, err := conftestTestCommand(ctx, files, "json", flags...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cleanup()
+
+	// errors are only reported when the results cannot be parsed, as conftest
+	// exits non-zero when there are failures. The results are written to
+	// stdout, and the builtin errors and the trace to stderr.
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, runErr := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, nil, fmt.Errorf("conftest was stopped after exceeding the test timeout of %s: %w", timeout, ctx.Err())
+	}
+
+	trace, policyErrors := splitBuiltinErrors(stderr.Bytes())
+	if traceFile != "" {
+		if err := ioutil.WriteFile(traceFile, trace, 0644); err != nil {
+			return nil, nil, fmt.Errorf("writing trace file: %w", err)
+		}
+	}
+
+	results, err := parseResults(out)
+	if err != nil {
+		if runErr != nil {
+			err = runErr
+		}
+		output := strings.TrimSpace(string(append(out, stderr.Bytes()...)))
+		if output == "" {
+			output = "(no output)"
+		}
+		return nil, nil, &executionError{output: output, err: err}
+	}
+
+	for i := range results {
+		name, index := paths.original(results[i].Filename)
+		results[i].Filename = name
+		if index < 0 {
+			continue
+		}
+
+		for _, list := range [][]jsonResult{results[i].Warnings, results[i].Failures, results[i].Exceptions} {
+			for j := range list {
+				list[j].Message = fmt.Sprintf("document %d: %s", index+1, list[j].Message)
+			}
+		}
+	}
+
+	return results, policyErrors, nil
+}
+
+// splitBuiltinErrors separates the builtin errors conftest reports on stderr
+// when --show-builtin-errors is set from the rest of stderr, such as the trace,
+// so that bugs in the policies are reported. The results on stdout are not
+// searched, as the message of a result may mention a builtin error.
+func splitBuiltinErrors(out []byte) ([]byte, []string) {
+	var results []string
+	var policyErrors []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if !strings.Contains(line, "eval_builtin_error") {
+			results = append(results, line)
+			continue
+		}
+
+		policyErrors = append(policyErrors, strings.TrimPrefix(strings.TrimSpace(line), "Error: "))
+	}
+
+	return []byte(strings.Join(results, "\n")), policyErrors
+}
+
+// runConftestJUnit runs conftest a second time with its native JUnit output,
+// writing the report to path.
+func runConftestJUnit(path string, files []string) error {
+	cmd, paths, cleanup, err := conftestTestCommand(context.Background(), files, "junit")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return fmt.Errorf("running conftest: %w", err)
+	}
+	if len(out) == 0 {
+		return fmt.Errorf("no junit output: %s", stderr.String())
+	}
+
+	// the temporary files are reported against the files they stand for
+	for _, replacement := range paths.replacements() {
+		var name bytes.Buffer
+		if err := xml.EscapeText(&name, []byte(replacement[1])); err != nil {
+			return fmt.Errorf("escaping %s: %w", replacement[1], err)
+		}
+		out = bytes.ReplaceAll(out, []byte(replacement[0]), name.Bytes())
+	}
+
+	if err := ioutil.WriteFile(path, out, 0644); err != nil {
+		return fmt.Errorf("writing junit file: %w", err)
+	}
+
+	return nil
+}
+
+// runConftestTrace runs conftest a second time with --trace, writing the trace
+// to w in a collapsed group of the log. The results are parsed from the first
+// run, as the trace is not part of the JSON output.
+func runConftestTrace(w io.Writer, files []string) error {
+	cmd, _, cleanup, err := conftestTestCommand(context.Background(), files, "stdout", "--trace")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return fmt.Errorf("running conftest: %w", err)
+	}
+
+	fmt.Fprintln(w, "::group::conftest trace")
+	w.Write(out)
+	if len(out) > 0 && out[len(out)-1] != '\n' {
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintln(w, "::endgroup::")
+
+	return nil
+}
+
+// junitTestSuites is a JUnit report of the results, with a test suite for each
+// file.
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// getJUnit returns a JUnit report of the results. Every check is a test case,
+// where failures fail the test case and warnings pass it with the warning in
+// its output.
+func getJUnit(results []jsonCheckResult) junitTestSuites {
+	var report junitTestSuites
+	for _, result := range results {
+		className := result.Filename
+		if result.Namespace != "" {
+			className = result.Filename + " " + result.Namespace
+		}
+
+		suite := junitTestSuite{Name: result.Filename}
+		for _, success := range result.Successes {
+			name := success.Message
+			if name == "" {
+				name = "passed"
+			}
+			suite.TestCases = append(suite.TestCases, junitTestCase{Name: name, ClassName: className})
+		}
+		for _, warn := range result.Warnings {
+			suite.TestCases = append(suite.TestCases, junitTestCase{Name: warn.Message, ClassName: className, SystemOut: "warning: " + warn.Message})
+		}
+		for _, fail := range result.Failures {
+			suite.TestCases = append(suite.TestCases, junitTestCase{Name: fail.Message, ClassName: className, Failure: &junitFailure{Message: fail.Message, Text: fail.Message}})
+			suite.Failures++
+		}
+
+		suite.Tests = len(suite.TestCases)
+		report.Suites = append(report.Suites, suite)
+	}
+
+	return report
+}
+
+// writeJUnit writes a JUnit report of the results to path.
+func writeJUnit(path string, results []jsonCheckResult) error {
+	out, err := xml.MarshalIndent(getJUnit(results), "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshalling junit: %w", err)
+	}
+
+	return ioutil.WriteFile(path, append([]byte(xml.Header), out...), 0644)
+}
+
+// conftestTestCommand returns the command that tests the files with the given
+// output format, along with the temporary paths passed to conftest in place of
+// the files. The returned cleanup function must be called
+// once the command has completed.
+func conftestTestCommand(ctx context.Context, files []string, output string, extraFlags ...string) (*exec.Cmd, tempPaths, func(), error) {
+	subcommand, err := getSubcommandFromEnv()
+	if err != nil {
+		return nil, tempPaths{}, nil, err
+	}
+
+	extraArgs, err := getExtraArgsFromEnv()
+	if err != nil {
+		return nil, tempPaths{}, nil, err
+	}
+
+	args := []string{subcommand, "--no-color", "--output", output}
+
+	// verify runs the unit tests of the policies, so it is only given where to
+	// find the policies and their data rather than the files and test flags
+	if subcommand == "verify" {
+		args = append(args, getVerifyFlags(append(getFlagsFromEnv(), extraArgs...))...)
+		args = append(args, extraFlags...)
+		cmd, err := conftestCommand(ctx, args...)
+		if err != nil {
+			return nil, tempPaths{}, nil, fmt.Errorf("creating conftest command: %w", err)
+		}
+		return cmd, tempPaths{}, func() {}, nil
+	}
+
+	flags := getFlagsFromEnv()
+	args = append(args, flags...)
+	args = append(args, extraFlags...)
+	args = append(args, extraArgs...)
+
+	// helm charts and kustomizations are rendered and tested through stdin
+	// instead of FILES
+	var stdin []byte
+	var paths tempPaths
+	cleanup := func() {}
+	if render := getRenderCommand(); render != nil {
+		files = []string{"-"}
+		stdin, err = renderManifests(ctx, render)
+		if err != nil {
+			return nil, tempPaths{}, nil, fmt.Errorf("rendering manifests with %s: %w", render[0], err)
+		}
+	} else {
+		files, paths.archives, cleanup, err = extractArchives(files, getTempDir())
+		if err != nil {
+			return nil, tempPaths{}, nil, fmt.Errorf("extracting archives: %w", err)
+		}
+	}
+
+	if envEnabled("SPLIT_YAML") {
+		var removeSplit func()
+		files, paths.documents, removeSplit, err = splitYAMLFiles(files, getTempDir())
+		if err != nil {
+			cleanup()
+			return nil, tempPaths{}, nil, fmt.Errorf("splitting yaml documents: %w", err)
+		}
+		removeArchives := cleanup
+		cleanup = func() {
+			removeArchives()
+			removeSplit()
+		}
+	}
+	args = append(args, files...)
+
+	input, removeInput, err := writeInputFromEnv(getTempDir())
+	if err != nil {
+		cleanup()
+		return nil, tempPaths{}, nil, err
+	}
+	if input != "" {
+		args = append(args, input)
+		removeArchives := cleanup
+		cleanup = func() {
+			removeArchives()
+			removeInput()
+		}
+	}
+
+	cmd, err := conftestCommand(ctx, args...)
+	if err != nil {
+		cleanup()
+		return nil, tempPaths{}, nil, fmt.Errorf("creating conftest command: %w", err)
+	}
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+
+	return cmd, paths, cleanup, nil
+}
+
+// tempPaths are the temporary paths passed to conftest in place of the files,
+// which only exist for the duration of the run.
+type tempPaths struct {
+	// archives maps the directories archives are extracted to to the archive
+	archives map[string]string
+
+	// documents maps the temporary file of each split document to the document
+	documents map[string]splitDocument
+}
+
+// original returns the name to report for a file tested by conftest, along with
+// the index of the document within the file when it was split, or -1. Files
+// extracted from an archive are named archive.tgz:inner/path.
+func (p tempPaths) original(path string) (string, int) {
+	index := -1
+	if doc, ok := p.documents[path]; ok {
+		path, index = doc.File, doc.Index
+	}
+
+	for dir, archive := range p.archives {
+		if rel := strings.TrimPrefix(path, dir+string(filepath.Separator)); rel != path {
+			return archive + ":" + filepath.ToSlash(rel), index
+		}
+	}
+
+	return path, index
+}
+
+// replacements returns the pairs of temporary paths and the names to report
+// for them in the text output of conftest.
+func (p tempPaths) replacements() [][2]string {
+	var out [][2]string
+	for docFile, doc := range p.documents {
+		out = append(out, [2]string{docFile, doc.String()})
+	}
+	for dir, archive := range p.archives {
+		out = append(out, [2]string{dir + string(filepath.Separator), archive + ":"})
+	}
+
+	return out
+}
+
+// splitDocument is a document of a multi-document YAML file, tested as a
+// temporary file of its own.
+type splitDocument struct {
+	File  string
+	Index int
+}
+
+func (d splitDocument) String() string {
+	return fmt.Sprintf("%s (document %d)", d.File, d.Index+1)
+}
+
+// splitYAMLFiles replaces the YAML files with multiple documents by a
+// temporary file for each document, so that violations are attributed to the
+// document they were found in. The returned documents map the temporary files
+// to the original file and the index of the document within it, as only the
+// original file exists in the repository.
+func splitYAMLFiles(files []string, tempDir string) ([]string, map[string]splitDocument, func(), error) {
+	var dirs []string
+	cleanup := func() {
+		for _, dir := range dirs {
+			os.RemoveAll(dir)
+		}
+	}
+
+	var out []string
+	documents := make(map[string]splitDocument)
+	for _, file := range files {
+		ext := filepath.Ext(file)
+		info, err := os.Stat(file)
+		if (ext != ".yaml" && ext != ".yml") || err != nil || !info.Mode().IsRegular() {
+			out = append(out, file)
+			continue
+		}
+
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			cleanup()
+			return nil, nil, nil, fmt.Errorf("reading %s: %w", file, err)
+		}
+
+		docs := splitYAMLDocuments(string(content))
+		if len(docs) < 2 {
+			out = append(out, file)
+			continue
+		}
+
+		dir, err := ioutil.TempDir(tempDir, "conftest-split-")
+		if err != nil {
+			cleanup()
+			return nil, nil, nil, fmt.Errorf("creating split dir: %w", err)
+		}
+		dirs = append(dirs, dir)
+
+		base := strings.TrimSuffix(filepath.Base(file), ext)
+		for i, doc := range docs {
+			name := fmt.Sprintf("%s.%d%s", base, i, ext)
+			docFile := filepath.Join(dir, name)
+			if err := ioutil.WriteFile(docFile, []byte(doc), 0644); err != nil {
+				cleanup()
+				return nil, nil, nil, fmt.Errorf("writing document %d of %s: %w", i, file, err)
+			}
+
+			out = append(out, docFile)
+			documents[docFile] = splitDocument{File: file, Index: i}
+		}
+	}
+
+	return out, documents, cleanup, nil
+}
+
+// splitYAMLDocuments splits content on the --- separators between YAML
+// documents, dropping empty documents.
+func splitYAMLDocuments(content string) []string {
+	var docs []string
+	var doc []string
+	flush := func() {
+		if joined := strings.Join(doc, "\n"); strings.TrimSpace(joined) != "" {
+			docs = append(docs, strings.TrimRight(joined, "\n")+"\n")
+		}
+		doc = nil
+	}
+
+	for _, line := range strings.Split(content, "\n") {
+		if strings.TrimRight(line, " \t\r") == "---" {
+			flush()
+			continue
+		}
+		doc = append(doc, line)
+	}
+	flush()
+
+	return docs
+}
+
+// getRenderCommand returns the command rendering the manifests to test. When
+// HELM is set, the chart at HELM_CHART is rendered with each of the HELM_VALUES
+// files. When KUSTOMIZE is set, the kustomization at KUSTOMIZE_DIR is built.
+// Both default to the current directory. It returns nil when neither is set.
+func getRenderCommand() []string {
+	switch {
+	case envEnabled("HELM"):
+		chart := os.Getenv("HELM_CHART")
+		if chart == "" {
+			chart = "."
+		}
+
+		command := []string{"helm", "template", chart}
+		for _, values := range getListFromEnv("HELM_VALUES") {
+			command = append(command, "--values", values)
+		}
+		return command
+
+	case envEnabled("KUSTOMIZE"):
+		dir := os.Getenv("KUSTOMIZE_DIR")
+		if dir == "" {
+			dir = "."
+		}
+		return []string{"kustomize", "build", dir}
+	}
+
+	return nil
+}
+
+// renderManifests runs the render command and returns the rendered manifests.
+func renderManifests(ctx context.Context, command []string) ([]byte, error) {
+	out, err := exec.CommandContext(ctx, command[0], command[1:]...).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("%s", exitErr.Stderr)
+		}
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// readResultsFiles reads the JSON output of conftest from each of the files
+// and merges the results.
+func readResultsFiles(files []string) ([]jsonCheckResult, error) {
+	var all [][]jsonCheckResult
+	for _, file := range files {
+		out, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", file, err)
+		}
+
+		results, err := parseResults(out)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		all = append(all, results)
+	}
+
+	return mergeResults(all...), nil
+}
+
+// mergeResults combines the results of multiple conftest runs. Results for the
+// same file and namespace are merged into one, dropping failures, warnings and
+// exceptions with a message that was already reported for it. Successes are
+// added together.
+func mergeResults(runs ...[]jsonCheckResult) []jsonCheckResult {
+	type key struct{ filename, namespace string }
+
+	var merged []jsonCheckResult
+	index := make(map[key]int)
+	for _, results := range runs {
+		for _, result := range results {
+			k := key{result.Filename, result.Namespace}
+			i, ok := index[k]
+			if !ok {
+				index[k] = len(merged)
+				merged = append(merged, jsonCheckResult{Filename: result.Filename, Namespace: result.Namespace})
+				i = len(merged) - 1
+			}
+
+			m := &merged[i]
+			m.Successes = append(m.Successes, result.Successes...)
+			m.Failures = appendUnique(m.Failures, result.Failures)
+			m.Warnings = appendUnique(m.Warnings, result.Warnings)
+			m.Exceptions = appendUnique(m.Exceptions, result.Exceptions)
+		}
+	}
+
+	return merged
+}
+
+// appendUnique appends the results in add with a message not yet in results.
+func appendUnique(results, add []jsonResult) []jsonResult {
+	for _, r := range add {
+		duplicate := false
+		for _, existing := range results {
+			if existing.Message == r.Message {
+				duplicate = true
+				break
+			}
+		}
+
+		if !duplicate {
+			results = append(results, r)
+		}
+	}
+
+	return results
+}
+
+// waiveFiles reports the failures of the waived files as warnings tagged as
+// waived, so that known issues in those files do not block the build.
+func waiveFiles(results []jsonCheckResult, waived []string) []jsonCheckResult {
+	if len(waived) == 0 {
+		return results
+	}
+
+	var cleaned []string
+	for _, w := range waived {
+		cleaned = append(cleaned, filepath.Clean(w))
+	}
+
+	for i, result := range results {
+		if len(result.Failures) == 0 || !contains(cleaned, filepath.Clean(result.Filename)) {
+			continue
+		}
+
+		for _, fail := range result.Failures {
+			fail.Message += " (waived)"
+			results[i].Warnings = append(results[i].Warnings, fail)
+		}
+		results[i].Failures = nil
+	}
+
+	return results
+}
+
+// policyWaiver waives the failures of a policy, optionally until an expiry date.
+type policyWaiver struct {
+	PolicyID string
+	Expires  time.Time
+}
+
+// parseWaivers parses waivers in the form policyID or policyID:YYYY-MM-DD.
+func parseWaivers(list []string) ([]policyWaiver, error) {
+	var waivers []policyWaiver
+	for _, w := range list {
+		parts := strings.SplitN(w, ":", 2)
+		waiver := policyWaiver{PolicyID: strings.TrimSpace(parts[0])}
+		if len(parts) == 2 {
+			expires, err := time.Parse("2006-01-02", strings.TrimSpace(parts[1]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid expiry date for %s: %w", waiver.PolicyID, err)
+			}
+			waiver.Expires = expires
+		}
+
+		waivers = append(waivers, waiver)
+	}
+
+	return waivers, nil
+}
+
+// waivePolicies reports the failures of waived policies as warnings tagged as
+// waived. A waiver applies until the end of its expiry date (UTC), after which
+// the failures are blocking again.
+func waivePolicies(results []jsonCheckResult, waivers []policyWaiver, policyIDKey string, now time.Time) []jsonCheckResult {
+	if len(waivers) == 0 {
+		return results
+	}
+
+	active := make(map[string]bool)
+	for _, w := range waivers {
+		if !w.Expires.IsZero() && !now.Before(w.Expires.AddDate(0, 0, 1)) {
+			fmt.Printf("The waiver for %s expired on %s and is no longer applied.\n", w.PolicyID, w.Expires.Format("2006-01-02"))
+			continue
+		}
+		active[w.PolicyID] = true
+	}
+
+	for i, result := range results {
+		var failures []jsonResult
+		for _, fail := range result.Failures {
+			policyID, err := getPolicyIDFromMetadata(fail.Metadata, resolvePolicyIDKey(policyIDKey, result.Namespace))
+			if err != nil || !active[policyID] {
+				failures = append(failures, fail)
+				continue
+			}
+
+			fail.Message += " (waived)"
+			results[i].Warnings = append(results[i].Warnings, fail)
+		}
+		results[i].Failures = failures
+	}
+
+	return results
+}
+
+// filterByTag removes the failures and warnings that are tagged, but not with
+// the given tag. Violations without any tags apply everywhere and are kept.
+func filterByTag(results []jsonCheckResult, tag string) []jsonCheckResult {
+	keep := func(violations []jsonResult) []jsonResult {
+		var kept []jsonResult
+		for _, v := range violations {
+			tags := getTagsFromMetadata(v.Metadata)
+			if len(tags) == 0 || contains(tags, tag) {
+				kept = append(kept, v)
+			}
+		}
+		return kept
+	}
+
+	for i := range results {
+		results[i].Failures = keep(results[i].Failures)
+		results[i].Warnings = keep(results[i].Warnings)
+	}
+
+	return results
+}
+
+// getTagsFromMetadata returns the tags of a result, which can either be set
+// alongside the message or in the details.
+func getTagsFromMetadata(metadata map[string]interface{}) []string {
+	tags, ok := metadata["tags"].([]interface{})
+	if !ok {
+		details, _ := metadata["details"].(map[string]interface{})
+		tags, _ = details["tags"].([]interface{})
+	}
+
+	var out []string
+	for _, tag := range tags {
+		out = append(out, fmt.Sprintf("%v", tag))
+	}
+
+	return out
+}
+
+// getInputFromEnv returns the decoded content of INPUT_B64 and the file
+// extension to test it with, taken from INPUT_TYPE.
+func getInputFromEnv() ([]byte, string, error) {
+	encoded := os.Getenv("INPUT_B64")
+	if encoded == "" {
+		return nil, "", nil
+	}
+
+	content, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, "", fmt.Errorf("decoding input-b64: %w", err)
+	}
+
+	inputType := os.Getenv("INPUT_TYPE")
+	if inputType == "" {
+		inputType = "yaml"
+	}
+	if strings.ContainsAny(inputType, `/\.`) {
+		return nil, "", fmt.Errorf("invalid input-type %q", inputType)
+	}
+
+	return content, inputType, nil
+}
+
+// writeInputFromEnv writes the content of INPUT_B64 to a temporary file in
+// tempDir, returning its path and a function removing it. The path is empty
+// when INPUT_B64 is not set.
+func writeInputFromEnv(tempDir string) (string, func(), error) {
+	content, inputType, err := getInputFromEnv()
+	if err != nil || content == nil {
+		return "", func() {}, err
+	}
+
+	f, err := ioutil.TempFile(tempDir, "conftest-input-*."+inputType)
+	if err != nil {
+		return "", nil, fmt.Errorf("creating input file: %w", err)
+	}
+	remove := func() { os.Remove(f.Name()) }
+
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		remove()
+		return "", nil, fmt.Errorf("writing input file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		remove()
+		return "", nil, fmt.Errorf("closing input file: %w", err)
+	}
+
+	return f.Name(), remove, nil
+}
+
+// extractArchives replaces any archives in files with a directory containing
+// their extracted contents, so that conftest tests the files in the archive.
+// The returned archives map these directories to the archive they were
+// extracted from, and the returned cleanup function removes the extracted
+// files.
+func extractArchives(files []string, tempDir string) ([]string, map[string]string, func(), error) {
+	var dirs []string
+	cleanup := func() {
+		for _, dir := range dirs {
+			os.RemoveAll(dir)
+		}
+	}
+
+	var extracted []string
+	archives := make(map[string]string)
+	for _, file := range files {
+		archiveType, err := getArchiveType(file)
+		if err != nil {
+			cleanup()
+			return nil, nil, nil, fmt.Errorf("detecting archive type of %s: %w", file, err)
+		}
+
+		if archiveType == "" {
+			extracted = append(extracted, file)
+			continue
+		}
+
+		dir, err := ioutil.TempDir(tempDir, "conftest-archive-")
+		if err != nil {
+			cleanup()
+			return nil, nil, nil, fmt.Errorf("creating extraction dir: %w", err)
+		}
+		dirs = append(dirs, dir)
+
+		if archiveType == "zip" {
+			err = extractZip(file, dir)
+		} else {
+			err = extractTarGz(file, dir)
+		}
+		if err != nil {
+			cleanup()
+			return nil, nil, nil, fmt.Errorf("extracting %s: %w", file, err)
+		}
+
+		extracted = append(extracted, dir)
+		archives[dir] = file
+	}
+
+	return extracted, archives, cleanup, nil
+}
+
+// getArchiveType returns "zip" or "tar.gz" when the file is an archive, based on
+// its extension or its magic bytes, and an empty string otherwise.
+func getArchiveType(file string) (string, error) {
+	switch {
+	case strings.HasSuffix(file, ".zip"):
+		return "zip", nil
+	case strings.HasSuffix(file, ".tar.gz"), strings.HasSuffix(file, ".tgz"):
+		return "tar.gz", nil
+	}
+
+	info, err := os.Stat(file)
+	if err != nil || info.IsDir() {
+		// leave missing files and directories for conftest to handle
+		return "", nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic[:n], []byte("PK\x03\x04")):
+		return "zip", nil
+	case bytes.HasPrefix(magic[:n], []byte{0x1f, 0x8b}):
+		return "tar.gz", nil
+	}
+
+	return "", nil
+}
+
+func extractTarGz(file, dir string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("reading gzip: %w", err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading tar: %w", err)
+		}
+
+		path, err := getExtractPath(dir, header.Name)
+		if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := writeExtractedFile(path, tr); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func extractZip(file, dir string) error {
+	r, err := zip.OpenReader(file)
+	if err != nil {
+		return fmt.Errorf("reading zip: %w", err)
+	}
+	defer r.Close()
+
+	for _, zf := range r.File {
+		path, err := getExtractPath(dir, zf.Name)
+		if err != nil {
+			return err
+		}
+
+		if zf.FileInfo().IsDir() {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+
+		rc, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		err = writeExtractedFile(path, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getExtractPath returns the path to extract an archive entry to, guarding
+// against entries that would be written outside of the extraction dir.
+func getExtractPath(dir, name string) (string, error) {
+	path := filepath.Join(dir, name)
+	if !strings.HasPrefix(path, filepath.Clean(dir)+string(os.PathSeparator)) {
+		return "", fmt.Errorf("invalid archive entry: %s", name)
+	}
+
+	return path, nil
+}
+
+func writeExtractedFile(path string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// parseResults parses the JSON output of conftest. The results are usually a
+// bare array, but some output modes wrap them in an object under "results".
+func parseResults(out []byte) ([]jsonCheckResult, error) {
+	var results []jsonCheckResult
+	arrayErr := json.Unmarshal(out, &results)
+	if arrayErr == nil {
+		return results, nil
+	}
+
+	var wrapped struct {
+		Results *[]jsonCheckResult `json:"results"`
+	}
+	if err := json.Unmarshal(out, &wrapped); err != nil || wrapped.Results == nil {
+		return nil, fmt.Errorf("parsing results: %w", arrayErr)
+	}
+
+	return *wrapped.Results, nil
+}
+
+// conftestCommand returns the command used to run conftest with the given
+// arguments, which is killed if ctx is done before it completes. When
+// CONFTEST_IMAGE is set conftest is run inside that image with the workspace
+// mounted, rather than using the conftest binary on the host, which is
+// CONFTEST_BIN or conftest on the PATH.
+func conftestCommand(ctx context.Context, args ...string) (*exec.Cmd, error) {
+	image := os.Getenv("CONFTEST_IMAGE")
+	if image == "" {
+		bin := os.Getenv("CONFTEST_BIN")
+		if bin == "" {
+			bin = "conftest"
+		}
+		return exec.CommandContext(ctx, bin, args...), nil
+	}
+
+	workspace, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("getting working directory: %w", err)
+	}
+
+	mounts, err := getActionMounts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting the mounts of the action container: %w", err)
+	}
+
+	return exec.CommandContext(ctx, "docker", getDockerArgs(image, workspace, getTempDir(), mounts, args)...), nil
+}
+
+// containerMount is a directory of the host mounted into a container.
+type containerMount struct {
+	Source      string `json:"Source"`
+	Destination string `json:"Destination"`
+}
+
+// getActionMounts returns the mounts of the container the action runs in. The
+// conftest container is started next to it through the docker socket of the
+// host, so the paths of the action container have to be translated to the
+// host. No mounts are returned when the action does not run in a container,
+// as the paths are then already host paths.
+func getActionMounts(ctx context.Context) ([]containerMount, error) {
+	if os.Getenv("GITHUB_WORKSPACE") != actionWorkspace {
+		return nil, nil
+	}
+
+	// the hostname of a container is its ID
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("getting hostname: %w", err)
+	}
+
+	out, err := exec.CommandContext(ctx, "docker", "inspect", "--format", "{{json .Mounts}}", hostname).Output()
+	if err != nil {
+		return nil, fmt.Errorf("inspecting container %s: %w", hostname, err)
+	}
+
+	var mounts []containerMount
+	if err := json.Unmarshal(out, &mounts); err != nil {
+		return nil, fmt.Errorf("decoding mounts: %w", err)
+	}
+
+	return mounts, nil
+}
+
+// getHostPath translates a path of the action container to the host, using
+// the mount the path is in.
+func getHostPath(path string, mounts []containerMount) string {
+	for _, m := range mounts {
+		if path == m.Destination || strings.HasPrefix(path, m.Destination+"/") {
+			return m.Source + strings.TrimPrefix(path, m.Destination)
+		}
+	}
+
+	return path
+}
+
+// getDockerArgs builds the docker run arguments for running conftest in the
+// given image. The workspace is mounted at containerWorkspace and used as the
+// working directory, so relative paths in FILES and POLICY resolve the same
+// way they do on the host. Absolute paths inside the workspace are rewritten
+// to their location in the container. The temp dir is mounted at the same path
+// so that temporary files, such as extracted archives, are available. The
+// mounted directories are translated to the host with the mounts of the action
+// container. Stdin is always attached, as rendered manifests are tested through
+// it.
+func getDockerArgs(image, workspace, tempDir string, mounts []containerMount, args []string) []string {
+	dockerArgs := []string{
+		"run", "--rm", "-i",
+		"-v", getHostPath(workspace, mounts) + ":" + containerWorkspace,
+		"-v", getHostPath(tempDir, mounts) + ":" + tempDir,
+		"-w", containerWorkspace,
+	}
+	for _, env := range containerEnvVars {
+		// the variables are only passed on when set in the environment of the
+		// docker command
+		dockerArgs = append(dockerArgs, "-e", env)
+	}
+	dockerArgs = append(dockerArgs, image)
+
+	for _, arg := range args {
+		if arg == workspace {
+			arg = containerWorkspace
+		} else if strings.HasPrefix(arg, workspace+"/") {
+			arg = containerWorkspace + strings.TrimPrefix(arg, workspace)
+		}
+
+		dockerArgs = append(dockerArgs, arg)
+	}
+
+	return dockerArgs
+}
+
+// resolvePolicyIDKey returns the policy ID keys to use for a result in the
+// given namespace. Entries of policyIDKey in the form namespace=key only apply
+// to results in that namespace, while the remaining entries are the default keys
+// used for all other namespaces. When there are no default keys, policyID is
+// used.
+func resolvePolicyIDKey(policyIDKey, namespace string) string {
+	var namespaceKeys, defaultKeys []string
+	for _, entry := range strings.Split(policyIDKey, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) == 1 {
+			defaultKeys = append(defaultKeys, entry)
+			continue
+		}
+
+		if strings.TrimSpace(parts[0]) == namespace {
+			namespaceKeys = append(namespaceKeys, strings.TrimSpace(parts[1]))
+		}
+	}
+
+	switch {
+	case len(namespaceKeys) > 0:
+		return strings.Join(namespaceKeys, ",")
+	case len(defaultKeys) > 0:
+		return strings.Join(defaultKeys, ",")
+	}
+
+	return defaultPolicyIDKey
+}
+
+// attributeFilename returns the file a violation from a combined result refers
+// to. A path or filename in the metadata details takes precedence, followed by
+// the first of the combined files mentioned in the message. When there is no
+// hint, or files is empty, filename is returned unchanged.
+func attributeFilename(filename string, r jsonResult, files []string) string {
+	if len(files) == 0 {
+		return filename
+	}
+
+	if details, ok := r.Metadata["details"].(map[string]interface{}); ok {
+		for _, key := range []string{"path", "filename"} {
+			if path, ok := details[key].(string); ok && path != "" {
+				return path
+			}
+		}
+	}
+
+	for _, file := range files {
+		if strings.Contains(r.Message, file) {
+			return file
+		}
+	}
+
+	return filename
+}
+
+// getPolicyIDFromMetadata returns the policy ID from the details of the
+// metadata. policyIDKey may be a comma separated list of keys, in which case the
+// first key present in the details is used.
+func getPolicyIDFromMetadata(metadata map[string]interface{}, policyIDKey string) (string, error) {
+	details, ok := metadata["details"].(map[string]interface{})
+	if !ok {
+		return "", fmt.Errorf("empty policyID key: metadata has no details")
+	}
+
+	for _, key := range strings.Split(policyIDKey, ",") {
+		key = strings.TrimSpace(key)
+		if details[key] != nil {
+			return fmt.Sprintf("%v", details[key]), nil
+		}
+	}
+
+	return "", fmt.Errorf("empty policyID key")
+}
+
+func getFlagsFromEnv() []string {
+	var args []string
+	for _, v := range conftestFlags {
+		env := os.Getenv(v)
+		if env == "" || strings.ToLower(env) == "false" {
+			continue
+		}
+
+		// all-namespaces defaults to true, so specific namespaces take its
+		// place rather than conflicting with it
+		if v == "ALL_NAMESPACES" && len(getListFromEnv("NAMESPACE")) > 0 {
+			continue
+		}
+
+		flag := getFlagFromEnv(v)
+		switch {
+		case strings.ToLower(env) == "true":
+			args = append(args, flag)
+		case contains(repeatableFlags, v):
+			for _, value := range getListFromEnv(v) {
+				args = append(args, flag, value)
+			}
+		default:
+			args = append(args, flag, env)
+		}
+	}
+
+	if dir := getAutoDataDir(); dir != "" && !contains(getListFromEnv("DATA"), dir) {
+		args = append(args, "--data", dir)
+	}
+
+	return args
+}
+
+// getExtraArgsFromEnv returns the arguments in EXTRA_ARGS, which are passed to
+// conftest verbatim after the flags set by the action.
+func getExtraArgsFromEnv() ([]string, error) {
+	args, err := splitArgs(os.Getenv("EXTRA_ARGS"))
+	if err != nil {
+		return nil, fmt.Errorf("parsing extra-args: %w", err)
+	}
+
+	return args, nil
+}
+
+// splitArgs splits s into arguments on whitespace, like a shell without any
+// expansion. Single quotes preserve everything up to the closing quote, while
+// double quotes and a backslash outside of quotes preserve the next character.
+// Within double quotes a backslash only escapes a double quote or a backslash.
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			if quote == '"' && r != '"' && r != '\\' {
+				current.WriteRune('\\')
+			}
+			current.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\\':
+			escaped = true
+			inArg = true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+
+	return args, nil
+}
+
+// getAutoDataDir returns the data directory alongside the policy directory when
+// AUTO_DATA is set and the directory exists. The name of the directory is taken
+// from AUTO_DATA_DIR, defaulting to data.
+func getAutoDataDir() string {
+	if !envEnabled("AUTO_DATA") {
+		return ""
+	}
+
+	policyDir := os.Getenv("POLICY")
+	if policyDir == "" {
+		policyDir = "policy"
+	}
+	name := os.Getenv("AUTO_DATA_DIR")
+	if name == "" {
+		name = "data"
+	}
+
+	dir := filepath.Join(filepath.Dir(filepath.Clean(policyDir)), name)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return ""
+	}
+
+	return dir
+}
+
+// getVersion returns the version of the action. The VERSION environment
+// variable takes precedence over the version set at build time.
+func getVersion() string {
+	if v := os.Getenv("VERSION"); v != "" {
+		return v
+	}
+
+	return version
+}
+
+// isVersionMode reports whether the action was asked to print its version,
+// either with a version argument or by setting MODE to version.
+func isVersionMode(args []string) bool {
+	if os.Getenv("MODE") == "version" {
+		return true
+	}
+
+	return len(args) > 0 && (args[0] == "version" || args[0] == "--version")
+}
+
+// printVersion writes the version of the action and of conftest.
+func printVersion(w io.Writer) error {
+	fmt.Fprintf(w, "action-conftest %s\n", getVersion())
+
+	out, err := getConftestVersion()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprint(w, out)
+	return nil
+}
+
+// getConftestVersion returns the output of conftest --version.
+func getConftestVersion() (string, error) {
+	cmd, err := conftestCommand(context.Background(), "--version")
+	if err != nil {
+		return "", fmt.Errorf("creating conftest command: %w", err)
+	}
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("getting conftest version: %w: %s", err, string(out))
+	}
+
+	return string(out), nil
+}
+
+// minConftestVersion is the oldest conftest release with the JSON output the
+// results are parsed from.
+const minConftestVersion = "0.20.0"
+
+var versionPattern = regexp.MustCompile(`(\d+)\.(\d+)\.(\d+)`)
+
+// checkConftestVersion checks that conftest is at least minConftestVersion,
+// and prints the version that was found.
+func checkConftestVersion(w io.Writer) error {
+	out, err := getConftestVersion()
+	if err != nil {
+		return err
+	}
+
+	version, err := parseVersion(out)
+	if err != nil {
+		return fmt.Errorf("getting conftest version: %w", err)
+	}
+	fmt.Fprintf(w, "Using conftest %d.%d.%d\n", version[0], version[1], version[2])
+
+	min, _ := parseVersion(minConftestVersion)
+	if versionLess(version, min) {
+		return fmt.Errorf("conftest %d.%d.%d is older than the minimum supported version %s", version[0], version[1], version[2], minConftestVersion)
+	}
+
+	return nil
+}
+
+// parseVersion returns the first version in the output of conftest --version,
+// which is the version of conftest as newer releases also print the version of
+// OPA.
+func parseVersion(out string) ([3]int, error) {
+	var version [3]int
+	match := versionPattern.FindStringSubmatch(out)
+	if match == nil {
+		return version, fmt.Errorf("no version found in %q", strings.TrimSpace(out))
+	}
+
+	for i := range version {
+		n, err := strconv.Atoi(match[i+1])
+		if err != nil {
+			return version, fmt.Errorf("parsing version %q: %w", match[0], err)
+		}
+		version[i] = n
+	}
+
+	return version, nil
+}
+
+// versionLess reports whether version a is older than version b.
+func versionLess(a, b [3]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+
+	return false
+}
+
+// verifyFlags are the flags of conftest test that conftest verify takes too,
+// including --update when it is passed in EXTRA_ARGS.
+var verifyFlags = []string{"--policy", "--data", "--update"}
+
+// getVerifyFlags returns the flags and their values that apply to conftest
+// verify, dropping the flags that only apply to testing files.
+func getVerifyFlags(flags []string) []string {
+	var out []string
+	for i := 0; i < len(flags); i++ {
+		if contains(verifyFlags, flags[i]) && i+1 < len(flags) {
+			out = append(out, flags[i], flags[i+1])
+			i++
+		}
+	}
+
+	return out
+}
+
+// getSubcommandFromEnv returns the conftest subcommand used to evaluate the
+// files, which defaults to test.
+func getSubcommandFromEnv() (string, error) {
+	subcommand := os.Getenv("CONFTEST_SUBCOMMAND")
+	if subcommand == "" {
+		return "test", nil
+	}
+
+	if !contains(conftestSubcommands, subcommand) {
+		return "", fmt.Errorf("unsupported conftest subcommand %q, must be one of: %s", subcommand, strings.Join(conftestSubcommands, ", "))
+	}
+
+	return subcommand, nil
+}
+
+// getFilesFromEnv returns the files to test. FILES is split on newlines so that
+// paths may contain spaces, falling back to splitting on spaces when there are
+// no newlines.
+func getFilesFromEnv() []string {
+	files := os.Getenv("FILES")
+	if strings.Contains(files, "\n") {
+		return getListFromEnv("FILES")
+	}
+
+	return strings.Fields(files)
+}
+
+// expandGlobs expands the entries containing * or ? into the files they match,
+// relative to the workspace. A ** segment matches any number of directories.
+// Entries that exist are never expanded, so that existing paths containing
+// these characters keep working. Patterns only match files, and the patterns
+// that did not match any file are returned so that the caller can decide
+// whether that is an error.
+func expandGlobs(entries []string) ([]string, []string, error) {
+	files := make([]string, 0, len(entries))
+	var unmatched []string
+	for _, entry := range entries {
+		if _, err := os.Stat(entry); err == nil || !strings.ContainsAny(entry, "*?") {
+			if !contains(files, entry) {
+				files = append(files, entry)
+			}
+			continue
+		}
+
+		matches, err := globFiles(entry)
+		if err != nil {
+			return nil, nil, fmt.Errorf("expanding %s: %w", entry, err)
+		}
+		if len(matches) == 0 {
+			unmatched = append(unmatched, entry)
+		}
+		for _, match := range matches {
+			if !contains(files, match) {
+				files = append(files, match)
+			}
+		}
+	}
+
+	return files, unmatched, nil
+}
+
+// globFiles returns the files matching the pattern, in lexical order.
+func globFiles(pattern string) ([]string, error) {
+	pattern = filepath.Clean(filepath.FromSlash(pattern))
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	// the directory before the first segment with metacharacters is walked,
+	// rather than the whole workspace
+	segments := strings.Split(pattern, string(filepath.Separator))
+	root := ""
+	for len(segments) > 1 && !strings.ContainsAny(segments[0], "*?[") {
+		root = filepath.Join(root, segments[0])
+		if segments[0] == "" {
+			root = string(filepath.Separator)
+		}
+		segments = segments[1:]
+	}
+	if root == "" {
+		root = "."
+	}
+
+	var matches []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if matchSegments(segments, strings.Split(rel, string(filepath.Separator))) {
+			matches = append(matches, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return matches, nil
+}
+
+// matchSegments reports whether the path segments match the pattern segments,
+// where a ** segment matches zero or more path segments.
+func matchSegments(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if matchSegments(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(path) == 0 {
+		return false
+	}
+	if ok, _ := filepath.Match(pattern[0], path[0]); !ok {
+		return false
+	}
+
+	return matchSegments(pattern[1:], path[1:])
+}
+
+// validateFlags checks the assembled conftest flags and files for combinations
+// that conftest would reject or silently ignore, so that the user gets an
+// actionable error rather than a confusing conftest failure.
+func validateFlags(flags []string, files []string) error {
+	for _, c := range flagConflicts {
+		if contains(flags, c.flags[0]) && contains(flags, c.flags[1]) {
+			return fmt.Errorf("%s and %s cannot be used together: %s", c.flags[0], c.flags[1], c.reason)
+		}
+	}
+
+	if contains(flags, "--combine") && contains(files, "-") {
+		return fmt.Errorf("--combine cannot be used when reading from stdin: there is only a single input to combine, remove combine or test files instead")
+	}
+
+	return nil
+}
+
+// validateIgnore checks that the ignore pattern compiles, as conftest reports
+// an invalid pattern with an opaque error. Conftest only takes a single ignore
+// pattern, so multiple patterns must be combined with alternation.
+func validateIgnore(pattern string) error {
+	if pattern == "" {
+		return nil
+	}
+
+	if _, err := regexp.Compile(pattern); err != nil {
+		return fmt.Errorf("ignore must be a valid regular expression, combine multiple patterns with | such as vendor/|generated/: %w", err)
+	}
+
+	return nil
+}
+
+// getReviewEventFromEnv returns the event of the review submitted when there
+// are no failures. Reviews are not submitted when REVIEW_EVENT is not set.
+func getReviewEventFromEnv() (string, error) {
+	event := strings.ToUpper(os.Getenv("REVIEW_EVENT"))
+	if event != "" && !contains(reviewEvents, event) {
+		return "", fmt.Errorf("unsupported review event %q, must be one of: %s", event, strings.Join(reviewEvents, ", "))
+	}
+
+	return event, nil
+}
+
+// getReviewEvent returns the event of the review for a run with the given
+// number of failures. Failures always request changes, so that the review
+// blocks the pull request.
+func getReviewEvent(cleanEvent string, fails int) string {
+	if fails > 0 {
+		return "REQUEST_CHANGES"
+	}
+
+	return cleanEvent
+}
+
+// postReview submits body as a review of the pull request when REVIEW_EVENT
+// is set.
+func postReview(body []byte, fails int) error {
+	cleanEvent, err := getReviewEventFromEnv()
+	if err != nil || cleanEvent == "" {
+		return err
+	}
+
+	review, err := json.Marshal(map[string]string{"body": string(body), "event": getReviewEvent(cleanEvent, fails)})
+	if err != nil {
+		return fmt.Errorf("marshalling review: %w", err)
+	}
+
+	ghToken := fmt.Sprintf("token %s", os.Getenv("GITHUB_TOKEN"))
+	if fails == 0 {
+		login := getCommentLogin(getCommentProvider())
+		if err := dismissStaleReviews(os.Getenv("GITHUB_REVIEW_URL"), getCommentMarker(), login, ghToken); err != nil {
+			return fmt.Errorf("dismissing stale reviews: %w", err)
+		}
+	}
+
+	return submitComment(os.Getenv("GITHUB_REVIEW_URL"), review, ghToken)
+}
+
+// dismissStaleReviews dismisses the reviews of previous runs that requested
+// changes, so that they no longer block the pull request once the failures are
+// resolved. The reviews of the action are identified by the marker in their
+// body and by being submitted by login, so that the review of someone quoting
+// the action is left alone.
+func dismissStaleReviews(reviewURL, marker, login, authz string) error {
+	type review struct {
+		ID    int64  `json:"id"`
+		Body  string `json:"body"`
+		State string `json:"state"`
+		User  struct {
+			Login string `json:"login"`
+		} `json:"user"`
+	}
+
+	var stale []review
+	err := listPages(reviewURL, authzHeader(authz), func(page []byte) (int, bool, error) {
+		var reviews []review
+		if err := json.Unmarshal(page, &reviews); err != nil {
+			return 0, false, fmt.Errorf("decoding reviews: %w", err)
+		}
+
+		for _, r := range reviews {
+			if r.State == "CHANGES_REQUESTED" && r.User.Login == login && strings.Contains(r.Body, fmt.Sprintf("<!-- %s -->", marker)) {
+				stale = append(stale, r)
+			}
+		}
+
+		return len(reviews), false, nil
+	})
+	if err != nil {
+		return fmt.Errorf("listing reviews: %w", err)
+	}
+
+	dismissal, err := json.Marshal(map[string]string{"message": "The conftest failures have been resolved.", "event": "DISMISS"})
+	if err != nil {
+		return fmt.Errorf("marshalling dismissal: %w", err)
+	}
+
+	for _, review := range stale {
+		if _, err := sendRequest("PUT", fmt.Sprintf("%s/%d/dismissals", reviewURL, review.ID), dismissal, authz, 0); err != nil {
+			return fmt.Errorf("dismissing review %d: %w", review.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// getCommentMarker returns the marker identifying the comments of this run.
+// MATRIX_KEY is appended to the marker, so that each job of a matrix has its
+// own comments rather than sharing one.
+func getCommentMarker() string {
+	marker := os.Getenv("COMMENT_MARKER")
+	if marker == "" {
+		marker = defaultCommentMarker
+	}
+
+	if key := strings.Join(strings.Fields(os.Getenv("MATRIX_KEY")), "-"); key != "" {
+		marker = fmt.Sprintf("%s-%s", marker, key)
+	}
+
+	return marker
+}
+
+// getComments returns the data for each comment to post. The comments are
+// identified by a hidden marker, and when SEPARATE_SEVERITY_COMMENTS is set the
+// failures and warnings are split into two comments with distinct markers. The
+// split comments are not grouped by severity, as each only has one kind.
+func getComments(d commentData) []commentData {
+	marker := getCommentMarker()
+
+	if !envEnabled("SEPARATE_SEVERITY_COMMENTS") {
+		d.Marker = marker
+		return []commentData{d}
+	}
+
+	var comments []commentData
+	if len(d.Fails) > 0 || len(d.PolicyErrors) > 0 {
+		fails := d
+		fails.Warns, fails.Exceptions, fails.Severities = nil, nil, nil
+		fails.Marker = marker + "-fails"
+		comments = append(comments, fails)
+	}
+	if len(d.Warns) > 0 {
+		warns := d
+		warns.Fails, warns.PolicyErrors, warns.Severities = nil, nil, nil
+		warns.Marker = marker + "-warns"
+		comments = append(comments, warns)
+	}
+
+	return comments
+}
+
+func renderTemplate(d commentData) ([]byte, error) {
+	text, err := getCommentTemplate()
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := parseCommentTemplate(text)
+	if err != nil {
+		return nil, fmt.Errorf("parsing template: %w", err)
+	}
+
+	var o bytes.Buffer
+	if err := t.Execute(&o, d); err != nil {
+		return nil, fmt.Errorf("executing template: %w", err)
+	}
+
+	// the marker identifies the comment when updating it, so it is added when a
+	// custom template leaves it out
+	if d.Marker != "" && !strings.Contains(o.String(), fmt.Sprintf("<!-- %s -->", d.Marker)) {
+		fmt.Fprintf(&o, "\n<!-- %s -->\n", d.Marker)
+	}
+
+	return o.Bytes(), nil
+}
+
+func parseCommentTemplate(text string) (*template.Template, error) {
+	return template.New("conftest").Funcs(template.FuncMap{"indent": indentContinuation}).Parse(text)
+}
+
+// getCommentTemplate returns the template of the comment, which is
+// COMMENT_TEMPLATE or the content of COMMENT_TEMPLATE_FILE when set, and the
+// built-in template otherwise.
+func getCommentTemplate() (string, error) {
+	if text := os.Getenv("COMMENT_TEMPLATE"); text != "" {
+		return text, nil
+	}
+
+	if path := os.Getenv("COMMENT_TEMPLATE_FILE"); path != "" {
+		text, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("reading comment template file: %w", err)
+		}
+		return string(text), nil
+	}
+
+	return commentTemplate, nil
+}
+
+// indentContinuation indents the continuation lines of a multi-line message, so
+// that the whole message remains part of its Markdown bullet.
+func indentContinuation(s string) string {
+	s = strings.TrimRight(strings.ReplaceAll(s, "\r\n", "\n"), "\n")
+	return strings.ReplaceAll(s, "\n", "\n  ")
+}
+
+func getCommentJSON(comment []byte) ([]byte, error) {
+	j, err := json.Marshal(map[string]string{"body": string(comment)})
+	if err != nil {
+		return nil, fmt.Errorf("marshalling comment: %w", err)
+	}
+
+	return j, nil
+}
+
+func submitPost(url string, data []byte, authz string, policy retryPolicy) error {
+	return submitPostWithHeaders(url, data, authzHeader(authz), policy)
+}
+
+// submitPostWithHeaders is submitPost with additional headers, such as an API
+// key required by a gateway in front of the server.
+func submitPostWithHeaders(url string, data []byte, headers http.Header, policy retryPolicy) error {
+	return policy.do("submitting "+url, func() error {
+		_, err := sendRequestWithHeaders("POST", url, data, headers, 0)
+		return err
+	})
+}
+
+// parseHeaders parses headers in the form Key: Value. A header given more than
+// once takes the last value.
+func parseHeaders(lines []string) (http.Header, error) {
+	headers := http.Header{}
+	for _, line := range lines {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid header %q, must be in the form Key: Value", line)
+		}
+		headers.Set(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	return headers, nil
+}
+
+// retryPolicy is how requests are retried. The delay before each retry doubles,
+// starting at delay, and is varied by up to the jitter fraction of it so that
+// concurrent jobs do not retry in lockstep.
+type retryPolicy struct {
+	attempts  int
+	delay     time.Duration
+	jitter    float64
+	retryable func(error) bool
+}
+
+// defaultMetricsRetries and defaultMetricsRetryDelay are used when
+// METRICS_RETRIES and METRICS_RETRY_DELAY are not set, so that a network blip
+// does not lose the data point.
+const (
+	defaultMetricsRetries    = 2
+	defaultMetricsRetryDelay = 500 * time.Millisecond
+)
+
+// defaultRetryJitter is the jitter of the retry policies when
+// HTTP_RETRY_JITTER is not set. defaultHTTPRetryDelay is the delay before the
+// first retry of integrations without their own default, which are not retried
+// unless HTTP_RETRIES is set.
+const (
+	defaultRetryJitter    = 0.2
+	defaultHTTPRetryDelay = time.Second
+)
+
+// getRetryPolicy returns the retry policy of an HTTP integration. The number of
+// retries and the delay are read from <prefix>_RETRIES and
+// <prefix>_RETRY_DELAY, falling back to HTTP_RETRIES and HTTP_RETRY_DELAY and
+// then to the given defaults. The jitter is read from HTTP_RETRY_JITTER.
+func getRetryPolicy(prefix string, retries int, delay time.Duration) (retryPolicy, error) {
+	retries, err := getIntFromEnv("HTTP_RETRIES", retries)
+	if err != nil {
+		return retryPolicy{}, err
+	}
+	delay, err = getDurationFromEnv("HTTP_RETRY_DELAY", delay)
+	if err != nil {
+		return retryPolicy{}, err
+	}
+	if prefix != "" {
+		if retries, err = getIntFromEnv(prefix+"_RETRIES", retries); err != nil {
+			return retryPolicy{}, err
+		}
+		if delay, err = getDurationFromEnv(prefix+"_RETRY_DELAY", delay); err != nil {
+			return retryPolicy{}, err
+		}
+	}
+	if retries < 0 {
+		return retryPolicy{}, fmt.Errorf("the number of retries must not be negative")
+	}
+
+	jitter := defaultRetryJitter
+	if env := os.Getenv("HTTP_RETRY_JITTER"); env != "" {
+		jitter, err = strconv.ParseFloat(env, 64)
+		if err != nil || jitter < 0 || jitter > 1 {
+			return retryPolicy{}, fmt.Errorf("HTTP_RETRY_JITTER must be a number between 0 and 1")
+		}
+	}
+
+	return retryPolicy{attempts: retries + 1, delay: delay, jitter: jitter, retryable: isRetryableHTTPError}, nil
+}
+
+// isRetryableHTTPError returns whether retrying the request may succeed, which
+// is the case for server errors, rate limiting, timeouts and failures to connect.
+// Other errors, such as an invalid URL, fail the same way on every attempt.
+func isRetryableHTTPError(err error) bool {
+	var httpErr *httpError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode >= 500 || httpErr.StatusCode == http.StatusTooManyRequests
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	// the connection failed or was closed before there was a response
+	var opErr *net.OpError
+	return errors.As(err, &opErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// backoff returns the delay before the retry following the given attempt.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	delay := p.delay << uint(attempt-1)
+	if p.jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * p.jitter * float64(delay))
+	}
+
+	return delay
+}
+
+// do runs f until it succeeds, fails with an error that is not retryable, or
+// the attempts run out. name describes f in the log of the retries.
+func (p retryPolicy) do(name string, f func() error) error {
+	var err error
+	for attempt := 1; attempt <= p.attempts; attempt++ {
+		if err = f(); err == nil {
+			return nil
+		}
+		if p.retryable != nil && !p.retryable(err) {
+			return err
+		}
+
+		if attempt < p.attempts {
+			delay := p.backoff(attempt)
+			fmt.Printf("%s failed (attempt %d of %d), retrying in %s: %s\n", name, attempt, p.attempts, delay, err)
+			time.Sleep(delay)
+		}
+	}
+
+	if p.attempts > 1 {
+		return fmt.Errorf("after %d attempts: %w", p.attempts, err)
+	}
+	return err
+}
+
+// sendRequest sends data to url and returns the body of the response. A zero
+// timeout waits for the response indefinitely.
+func sendRequest(method, url string, data []byte, authz string, timeout time.Duration) ([]byte, error) {
+	return sendRequestWithHeaders(method, url, data, authzHeader(authz), timeout)
+}
+
+// authzHeader returns the header authorizing a request with the Authorization
+// header, which is empty when authz is.
+func authzHeader(authz string) http.Header {
+	headers := http.Header{}
+	if authz != "" {
+		headers.Set("Authorization", authz)
+	}
+
+	return headers
+}
+
+// sendRequestWithHeaders is sendRequest for services that are not authorized
+// through the Authorization header.
+func sendRequestWithHeaders(method, url string, data []byte, headers http.Header, timeout time.Duration) ([]byte, error) {
+	var reqBody io.Reader
+	if data != nil {
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, url, reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("creating http request: %w", err)
+	}
+
+	if data != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+
+	c := http.Client{Timeout: timeout}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("submitting http request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if err != nil {
+			body = []byte(fmt.Sprintf("unable to read response body: %s", err))
+		}
+
+		return nil, &httpError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading response body: %w", err)
+	}
+
+	return body, nil
+}
+
+// createGist creates a secret gist holding the rendered report and the raw
+// conftest results, and returns its URL.
+func createGist(apiURL string, report []byte, results []jsonCheckResult, authz string) (string, error) {
+	data, err := getGistJSON(report, results)
+	if err != nil {
+		return "", err
+	}
+
+	body, err := sendRequest("POST", getGistsURL(apiURL), data, authz, 0)
+	if err != nil {
+		return "", err
+	}
+
+	var created struct {
+		HTMLURL string `json:"html_url"`
+	}
+	if err := json.Unmarshal(body, &created); err != nil {
+		return "", fmt.Errorf("decoding gist response: %w", err)
+	}
+
+	return created.HTMLURL, nil
+}
+
+// datadogEvent is an event posted to the Datadog events API.
+type datadogEvent struct {
+	Title     string   `json:"title"`
+	Text      string   `json:"text"`
+	Tags      []string `json:"tags,omitempty"`
+	AlertType string   `json:"alert_type"`
+}
+
+// defaultDatadogSite is the Datadog site events are posted to when DATADOG_SITE
+// is not set.
+const defaultDatadogSite = "datadoghq.com"
+
+// getDatadogEventsURL returns the URL of the events API of the Datadog site,
+// such as datadoghq.eu.
+func getDatadogEventsURL(site string) string {
+	if site == "" {
+		site = defaultDatadogSite
+	}
+
+	return fmt.Sprintf("https://api.%s/api/v1/events", site)
+}
+
+// getDatadogEvent returns an event summarizing the run, tagged with the
+// repository and branch. Failures raise an error event and warnings a warning
+// event.
+func getDatadogEvent(successes, fails, warns int, repo, branch string) datadogEvent {
+	event := datadogEvent{
+		Title:     "Conftest passed",
+		Text:      fmt.Sprintf("%d failures, %d warnings and %d passing checks", fails, warns, successes),
+		Tags:      []string{"source:conftest"},
+		AlertType: "success",
+	}
+
+	switch {
+	case fails > 0:
+		event.Title = fmt.Sprintf("Conftest found %d failures", fails)
+		event.AlertType = "error"
+	case warns > 0:
+		event.Title = fmt.Sprintf("Conftest found %d warnings", warns)
+		event.AlertType = "warning"
+	}
+
+	if repo != "" {
+		event.Title += " in " + repo
+		event.Tags = append(event.Tags, "repo:"+repo)
+	}
+	if branch != "" {
+		event.Tags = append(event.Tags, "branch:"+branch)
+	}
+
+	return event
+}
+
+// submitDatadogEvent posts the event to the Datadog events API, which is
+// authorized with the API key in the DD-API-KEY header.
+func submitDatadogEvent(url string, event datadogEvent, apiKey string, policy retryPolicy) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("marshalling datadog event: %w", err)
+	}
+
+	headers := http.Header{}
+	headers.Set("DD-API-KEY", apiKey)
+	return policy.do("submitting datadog event", func() error {
+		_, err := sendRequestWithHeaders("POST", url, data, headers, 0)
+		return err
+	})
+}
+
+// slackMessage is a Slack message built from Block Kit blocks, with a plain
+// text fallback for notifications.
+type slackMessage struct {
+	Text   string       `json:"text"`
+	Blocks []slackBlock `json:"blocks"`
+}
+
+type slackBlock struct {
+	Type string     `json:"type"`
+	Text *slackText `json:"text,omitempty"`
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// slackMaxViolations is the number of violations listed in the Slack message,
+// the rest are only counted.
+const slackMaxViolations = 5
+
+// runContext is the repository, commit and pull request a run is for, taken
+// from the environment variables of the runner.
+type runContext struct {
+	ServerURL   string
+	Repository  string
+	SHA         string
+	PullRequest string
+	RunID       string
+}
+
+// getRunContext returns the context of the run. The pull request number is
+// parsed from GITHUB_REF, which is refs/pull/<number>/merge for pull requests.
+func getRunContext() runContext {
+	c := runContext{
+		ServerURL:  os.Getenv("GITHUB_SERVER_URL"),
+		Repository: os.Getenv("GITHUB_REPOSITORY"),
+		SHA:        os.Getenv("GITHUB_SHA"),
+		RunID:      os.Getenv("GITHUB_RUN_ID"),
+	}
+	if c.ServerURL == "" {
+		c.ServerURL = "https://github.com"
+	}
+
+	if parts := strings.Split(os.Getenv("GITHUB_REF"), "/"); len(parts) == 4 && parts[0] == "refs" && parts[1] == "pull" {
+		c.PullRequest = parts[2]
+	}
+
+	return c
+}
+
+// getSlackMessage returns a message with the number of failures and warnings,
+// the context of the run and the first few violations, failures first.
+func getSlackMessage(fails, warns []violation, c runContext) slackMessage {
+	title := fmt.Sprintf("Conftest found %d failures and %d warnings", len(fails), len(warns))
+	if c.Repository != "" {
+		title += " in " + c.Repository
+	}
+
+	var details []string
+	if c.Repository != "" {
+		repoURL := fmt.Sprintf("%s/%s", c.ServerURL, c.Repository)
+		details = append(details, fmt.Sprintf("*Repository:* <%s|%s>", repoURL, c.Repository))
+		if c.PullRequest != "" {
+			details = append(details, fmt.Sprintf("*Pull request:* <%s/pull/%s|#%s>", repoURL, c.PullRequest, c.PullRequest))
+		}
+		if c.SHA != "" {
+			sha := c.SHA
+			if len(sha) > 7 {
+				sha = sha[:7]
+			}
+			details = append(details, fmt.Sprintf("*Commit:* <%s/commit/%s|%s>", repoURL, c.SHA, sha))
+		}
+		if c.RunID != "" {
+			details = append(details, fmt.Sprintf("*Run:* <%s/actions/runs/%s|%s>", repoURL, c.RunID, c.RunID))
+		}
+	}
+
+	message := slackMessage{
+		Text:   title,
+		Blocks: []slackBlock{{Type: "header", Text: &slackText{Type: "plain_text", Text: title}}},
+	}
+	if len(details) > 0 {
+		message.Blocks = append(message.Blocks, slackBlock{Type: "section", Text: &slackText{Type: "mrkdwn", Text: strings.Join(details, "\n")}})
+	}
+
+	violations := append(append([]violation{}, fails...), warns...)
+	var lines []string
+	for i, v := range violations {
+		if i == slackMaxViolations {
+			lines = append(lines, fmt.Sprintf("_and %d more_", len(violations)-slackMaxViolations))
+			break
+		}
+		lines = append(lines, fmt.Sprintf("• `%s` - %s", v.Filename, v.Message))
+	}
+	if len(lines) > 0 {
+		message.Blocks = append(message.Blocks, slackBlock{Type: "section", Text: &slackText{Type: "mrkdwn", Text: strings.Join(lines, "\n")}})
+	}
+
+	return message
+}
+
+// submitSlackMessage posts the message to the Slack incoming webhook.
+func submitSlackMessage(url string, message slackMessage, policy retryPolicy) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("marshalling slack message: %w", err)
+	}
+
+	return submitPost(url, data, "", policy)
+}
+
+// webhookData is available to the template of the webhook body.
+type webhookData struct {
+	Successes  int
+	Failures   int
+	Warnings   int
+	Fails      []violation
+	Warns      []violation
+	Results    []jsonCheckResult
+	Repository string
+	SHA        string
+	Branch     string
+	Oneline    string
+}
+
+// defaultWebhookTemplate is the body of the webhook when WEBHOOK_TEMPLATE_FILE
+// is not set.
+const defaultWebhookTemplate = `{"text": {{ json .Oneline }}, "successes": {{ .Successes }}, "failures": {{ .Failures }}, "warnings": {{ .Warnings }}}`
+
+// getWebhookTemplate returns the template of the webhook body, read from
+// WEBHOOK_TEMPLATE_FILE when set. The json function encodes a value as JSON, so
+// that strings are quoted and escaped.
+func getWebhookTemplate() (*template.Template, error) {
+	text := defaultWebhookTemplate
+	if path := os.Getenv("WEBHOOK_TEMPLATE_FILE"); path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading webhook template file: %w", err)
+		}
+		text = string(content)
+	}
+
+	t, err := template.New("webhook").Funcs(template.FuncMap{"json": marshalTemplateJSON}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook template: %w", err)
+	}
+
+	return t, nil
+}
+
+func marshalTemplateJSON(v interface{}) (string, error) {
+	out, err := json.Marshal(v)
+	return string(out), err
+}
+
+// renderWebhook renders the body of the webhook, which must be valid JSON.
+func renderWebhook(d webhookData) ([]byte, error) {
+	t, err := getWebhookTemplate()
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	if err := t.Execute(&body, d); err != nil {
+		return nil, fmt.Errorf("executing webhook template: %w", err)
+	}
+	if !json.Valid(body.Bytes()) {
+		return nil, fmt.Errorf("webhook template did not render valid json: %s", body.String())
+	}
+
+	return body.Bytes(), nil
+}
+
+// submitWebhook posts the rendered body to the webhook.
+func submitWebhook(url string, d webhookData, policy retryPolicy) error {
+	body, err := renderWebhook(d)
+	if err != nil {
+		return err
+	}
+
+	return submitPost(url, body, "", policy)
+}
+
+// getBranch returns the branch of the run, which is the head branch for pull
+// requests.
+func getBranch() string {
+	if branch := os.Getenv("GITHUB_HEAD_REF"); branch != "" {
+		return branch
+	}
+
+	return os.Getenv("GITHUB_REF_NAME")
+}
+
+// parseKeyValues parses a comma or newline separated list of key=value pairs.
+func parseKeyValues(s string) (map[string]string, error) {
+	pairs := make(map[string]string)
+	for _, pair := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid pair %q, must be in the form key=value", pair)
+		}
+
+		pairs[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return pairs, nil
+}
+
+// getMetricsLabels returns the labels to include in the metrics from
+// METRICS_LABELS, with ENVIRONMENT added as the environment label.
+func getMetricsLabels() (map[string]string, error) {
+	labels, err := parseKeyValues(os.Getenv("METRICS_LABELS"))
+	if err != nil {
+		return nil, err
+	}
+
+	if env := os.Getenv("ENVIRONMENT"); env != "" {
+		labels["environment"] = env
+	}
+
+	if len(labels) == 0 {
+		return nil, nil
+	}
+
+	return labels, nil
+}
+
+// setMetricsContext sets the repository, commit, ref, branch and pull request
+// of the run on the metrics, so that they can be correlated with the change.
+func setMetricsContext(metrics *metricsSubmission, c runContext) {
+	metrics.Repository = c.Repository
+	metrics.SHA = c.SHA
+	metrics.Ref = os.Getenv("GITHUB_REF")
+	metrics.Branch = getBranch()
+	metrics.PullRequest, _ = strconv.Atoi(c.PullRequest)
+}
+
+// marshalMetrics marshals the metrics, renaming the top level fields according
+// to fieldMap so that the submission can match the schema of the metrics server.
+func marshalMetrics(metrics metricsSubmission, fieldMap map[string]string) ([]byte, error) {
+	metricsJSON, err := json.Marshal(metrics)
+	if err != nil || len(fieldMap) == 0 {
+		return metricsJSON, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(metricsJSON, &fields); err != nil {
+		return nil, err
+	}
+
+	renamed := make(map[string]json.RawMessage, len(fields))
+	for name, value := range fields {
+		if to, ok := fieldMap[name]; ok {
+			name = to
+		}
+		renamed[name] = value
+	}
+
+	return json.Marshal(renamed)
+}
+
+// appendMetrics appends the metrics as a line of newline delimited JSON, so that
+// the metrics of many runs can be accumulated and submitted later.
+func appendMetrics(path string, metricsJSON []byte) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("opening metrics file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(metricsJSON, '\n')); err != nil {
+		return fmt.Errorf("writing metrics: %w", err)
+	}
+
+	return nil
+}
+
+// runConcurrently runs the independent tasks with at most limit running at the
+// same time, returning the errors of all tasks that failed.
+func runConcurrently(limit int, tasks []func() error) error {
+	if limit < 1 {
+		limit = 1
+	}
+
+	var mu sync.Mutex
+	var errs multiError
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, limit)
+	for _, task := range tasks {
+		task := task
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := task(); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return errs
+}
+
+// submitComment posts the comment to GitHub.
+func submitComment(url string, data []byte, authz string) error {
+	return sendComment("POST", url, data, authzHeader(authz))
+}
+
+// sendComment sends the comment with the given method, retrying when the
+// server fails with a server error. Client errors, such as a 422 for a body
+// that is too large, are returned immediately as retrying them would not
+// change the outcome.
+func sendComment(method, url string, data []byte, header http.Header) error {
+	policy, err := getRetryPolicy("COMMENT", commentRetries, commentRetryDelay)
+	if err != nil {
+		return err
+	}
+	timeout, err := getDurationFromEnv("COMMENT_TIMEOUT", 0)
+	if err != nil {
+		return err
+	}
+
+	err = policy.do("submitting comment", func() error {
+		_, err := sendRequestWithHeaders(method, url, data, header, timeout)
+		return err
+	})
+
+	var httpErr *httpError
+	if errors.As(err, &httpErr) && !isRetryableHTTPError(err) {
+		return fmt.Errorf("the comment was rejected: %w", err)
+	}
+
+	return err
+}
+
+// commentProvider is where the comments are posted and how the requests are
+// authorized.
+type commentProvider struct {
+	Name   string
+	URL    string
+	Header http.Header
+
+	// CanUpdate is whether comments can be found by their marker and updated
+	CanUpdate bool
+
+	// UserURL returns the user the token belongs to, whose comments are the
+	// only ones updated
+	UserURL string
+}
+
+// defaultCommentLogin is the user comments are posted as with the GITHUB_TOKEN
+// of the workflow, which cannot read its own user.
+const defaultCommentLogin = "github-actions[bot]"
+
+// getCommentProvider returns GitLab when GITLAB_MR_URL and GITLAB_TOKEN are
+// set, posting the comment as a note on the merge request, and GitHub
+// otherwise.
+func getCommentProvider() commentProvider {
+	if mrURL, token := os.Getenv("GITLAB_MR_URL"), os.Getenv("GITLAB_TOKEN"); mrURL != "" && token != "" {
+		header := http.Header{}
+		header.Set("PRIVATE-TOKEN", token)
+		return commentProvider{Name: "gitlab", URL: mrURL, Header: header}
+	}
+
+	apiURL := os.Getenv("GITHUB_API_URL")
+	if apiURL == "" {
+		apiURL = defaultGitHubAPIURL
+	}
+
+	return commentProvider{
+		Name:      "github",
+		URL:       os.Getenv("GITHUB_COMMENT_URL"),
+		Header:    authzHeader(fmt.Sprintf("token %s", os.Getenv("GITHUB_TOKEN"))),
+		CanUpdate: true,
+		UserURL:   strings.TrimSuffix(apiURL, "/") + "/user",
+	}
+}
+
+// getCommentLogin returns the login of the user the comments are posted as,
+// falling back to defaultCommentLogin when the token cannot read its user.
+func getCommentLogin(provider commentProvider) string {
+	if provider.UserURL == "" {
+		return defaultCommentLogin
+	}
+
+	body, err := sendRequestWithHeaders("GET", provider.UserURL, nil, provider.Header, 0)
+	if err != nil {
+		return defaultCommentLogin
+	}
+
+	var user struct {
+		Login string `json:"login"`
+	}
+	if err := json.Unmarshal(body, &user); err != nil || user.Login == "" {
+		return defaultCommentLogin
+	}
+
+	return user.Login
+}
+
+// upsertComment posts the comment to the provider. With UPDATE_COMMENT, the
+// comment previously posted with the same marker is updated instead, so that
+// every push does not add another comment to the PR. With
+// COMMENT_ONLY_ON_CHANGE, a comment that already has the same body is left
+// alone, so that reruns do not notify the subscribers again.
+func upsertComment(provider commentProvider, marker string, data []byte) error {
+	if !envEnabled("UPDATE_COMMENT") || !provider.CanUpdate {
+		return sendComment("POST", provider.URL, data, provider.Header)
+	}
+
+	existing, body, err := findComment(provider, marker, getCommentLogin(provider))
+	if err != nil {
+		return fmt.Errorf("finding the existing comment: %w", err)
+	}
+	if existing == "" {
+		return sendComment("POST", provider.URL, data, provider.Header)
+	}
+
+	if envEnabled("COMMENT_ONLY_ON_CHANGE") {
+		var comment struct {
+			Body string `json:"body"`
+		}
+		if err := json.Unmarshal(data, &comment); err != nil {
+			return fmt.Errorf("parsing comment: %w", err)
+		}
+		if strings.TrimSpace(comment.Body) == strings.TrimSpace(body) {
+			fmt.Printf("The comment %s is unchanged, not updating it\n", existing)
+			return nil
+		}
+	}
+
+	return sendComment("PATCH", existing, data, provider.Header)
+}
+
+// resolvedCommentBody replaces the comment of a previous run with
+// COMMENT_ON_SUCCESS once the violations are resolved.
+const resolvedCommentBody = "**All policy checks passing ✅**\n<!-- %s -->\n"
+
+// resolveComments deletes the comments previously posted by the action with
+// DELETE_RESOLVED_COMMENT, or replaces them with a short passing message with
+// COMMENT_ON_SUCCESS, so that the comments do not linger after the violations
+// are resolved. The comments are left as they are otherwise.
+func resolveComments(provider commentProvider) error {
+	deleteComment := envEnabled("DELETE_RESOLVED_COMMENT")
+	if (!deleteComment && !envEnabled("COMMENT_ON_SUCCESS")) || !provider.CanUpdate {
+		return nil
+	}
+
+	marker := getCommentMarker()
+	login := getCommentLogin(provider)
+	for _, m := range []string{marker, marker + "-fails", marker + "-warns"} {
+		existing, _, err := findComment(provider, m, login)
+		if err != nil {
+			return fmt.Errorf("finding the existing comment: %w", err)
+		}
+		if existing == "" {
+			continue
+		}
+
+		if deleteComment {
+			if err := sendComment("DELETE", existing, nil, provider.Header); err != nil {
+				return err
+			}
+			continue
+		}
+
+		data, err := getCommentJSON([]byte(fmt.Sprintf(resolvedCommentBody, m)))
+		if err != nil {
+			return fmt.Errorf("get comment json: %w", err)
+		}
+		if err := sendComment("PATCH", existing, data, provider.Header); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// commentsPerPage is the number of comments or reviews listed per request.
+const commentsPerPage = 100
+
+// listPages requests url page by page, passing each page to visit, which
+// returns the number of items on the page and whether to stop. The pages are
+// listed until visit stops or a page is not full.
+func listPages(url string, header http.Header, visit func(body []byte) (int, bool, error)) error {
+	for page := 1; ; page++ {
+		body, err := sendRequestWithHeaders("GET", fmt.Sprintf("%s?per_page=%d&page=%d", url, commentsPerPage, page), nil, header, 0)
+		if err != nil {
+			return err
+		}
+
+		n, done, err := visit(body)
+		if err != nil || done || n < commentsPerPage {
+			return err
+		}
+	}
+}
+
+// findComment returns the API URL and the body of the first comment of the
+// provider with the hidden marker posted by login, or empty strings when there
+// is none, so that a marker pasted into the comment of someone else is ignored.
+func findComment(provider commentProvider, marker, login string) (string, string, error) {
+	var url, body string
+	err := listPages(provider.URL, provider.Header, func(page []byte) (int, bool, error) {
+		var comments []struct {
+			URL  string `json:"url"`
+			Body string `json:"body"`
+			User struct {
+				Login string `json:"login"`
+			} `json:"user"`
+		}
+		if err := json.Unmarshal(page, &comments); err != nil {
+			return 0, false, fmt.Errorf("parsing comments: %w", err)
+		}
+
+		for _, c := range comments {
+			if c.User.Login == login && strings.Contains(c.Body, fmt.Sprintf("<!-- %s -->", marker)) {
+				url, body = c.URL, c.Body
+				return len(comments), true, nil
+			}
+		}
+
+		return len(comments), false, nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return url, body, nil
+}
+
+// detectDeadPolicies returns the expected policy IDs that did not report a
+// violation for any of the files, which may indicate that they no longer match
+// anything.
+func detectDeadPolicies(expected, fired []string) []string {
+	var dead []string
+	for _, policyID := range expected {
+		if !contains(fired, policyID) && !contains(dead, policyID) {
+			dead = append(dead, policyID)
+		}
+	}
+
+	return dead
+}
+
+// getCoverage returns the percentage of evaluated checks that passed. When no
+// checks were evaluated at all the coverage is 0, as nothing was verified.
+func getCoverage(successes, fails, warns int) float64 {
+	total := successes + fails + warns
+	if total == 0 {
+		return 0
+	}
+
+	return float64(successes) / float64(total) * 100
+}
+
+// getOneline summarizes the run in a single line for chat bots. The repository
+// and the short commit SHA are included when known.
+func getOneline(successes, fails, warns int, repo, sha string) string {
+	line := fmt.Sprintf("conftest: %d fail, %d warn, %d pass", fails, warns, successes)
+	if repo == "" {
+		return line
+	}
+
+	line += " in " + repo
+	if sha != "" {
+		if len(sha) > 7 {
+			sha = sha[:7]
+		}
+		line += "@" + sha
+	}
+
+	return line
+}
+
+// isHealthy reports whether a run is considered healthy. A run is never healthy
+// when there are failures, and is only healthy with warnings when the number of
+// warnings does not exceed maxWarnings. A negative maxWarnings allows any number
+// of warnings.
+func isHealthy(fails, warns, maxWarnings int) bool {
+	if fails > 0 {
+		return false
+	}
+
+	return maxWarnings < 0 || warns <= maxWarnings
+}
+
+// setOutput writes a step output to the file GitHub Actions provides through
+// GITHUB_OUTPUT. It is a no-op when running outside of GitHub Actions.
+func setOutput(name, value string) error {
+	outputFile := os.Getenv("GITHUB_OUTPUT")
+	if outputFile == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(outputFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("opening output file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintf(f, "%s=%s\n", name, value); err != nil {
+		return fmt.Errorf("writing output: %w", err)
+	}
+
+	return nil
+}
+
+// setCountOutputs sets the number of successes, failures and warnings as step
+// outputs.
+func setCountOutputs(successes, fails, warns int) error {
+	counts := []struct {
+		name  string
+		count int
+	}{
+		{"fails", fails},
+		{"warns", warns},
+		{"successes", successes},
+	}
+	for _, c := range counts {
+		if err := setOutput(c.name, strconv.Itoa(c.count)); err != nil {
+			return fmt.Errorf("setting %s output: %w", c.name, err)
+		}
+	}
+
+	return nil
+}
+
+// registerProblemMatcher writes the conftest problem matcher to dir and
+// registers it with the runner, so that the lines written by printProblems are
+// turned into annotations.
+func registerProblemMatcher(w io.Writer, dir string) error {
+	path := filepath.Join(dir, "conftest-matcher.json")
+	if err := ioutil.WriteFile(path, []byte(problemMatcher), 0644); err != nil {
+		return fmt.Errorf("writing problem matcher: %w", err)
+	}
+
+	fmt.Fprintf(w, "::add-matcher::%s\n", path)
+	return nil
+}
+
+// printProblems writes a line in the format understood by the conftest problem
+// matcher for every failure and warning. Newlines in the messages are escaped so
+// that each violation stays on a single line.
+func printProblems(w io.Writer, results []jsonCheckResult) {
+	for _, result := range results {
+		for _, fail := range result.Failures {
+			fmt.Fprintf(w, "conftest error %s: %s\n", result.Filename, escapeAnnotationData(fail.Message))
+		}
+		for _, warn := range result.Warnings {
+			fmt.Fprintf(w, "conftest warning %s: %s\n", result.Filename, escapeAnnotationData(warn.Message))
+		}
+	}
 }
 
-type metricsSeverity struct {
-	Count     int      `json:"count,omitempty"`
-	PolicyIDs []string `json:"policyIDs,omitempty"`
+// printSummaryAnnotation writes a single annotation with the number of
+// failures and warnings, as an error when there are failures.
+func printSummaryAnnotation(w io.Writer, fails, warns int) {
+	if fails == 0 && warns == 0 {
+		return
+	}
+
+	level := "warning"
+	if fails > 0 {
+		level = "error"
+	}
+
+	msg := fmt.Sprintf("Conftest found %d policy violations and %d warnings", fails, warns)
+	fmt.Fprintf(w, "::%s title=%s::%s\n", level, escapeAnnotationProperty("Conftest"), escapeAnnotationData(msg))
 }
 
-const commentTemplate = `**Conftest has identified issues with your resources**
-{{ if .Fails }}
-The following policy violations were identified. These are blocking and must be remediated before proceeding.
+// sarifLog is the subset of SARIF 2.1.0 needed to upload the results to code
+// scanning.
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
 
-{{ range .Fails }}* {{ . }}
-{{ end }}{{ end }}{{ if .Warns }}
-The following warnings were identified. These are issues that indicate the resources are not following best practices.
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
 
-{{ range .Warns }}* {{ . }}
-{{ end }}{{ end }}
-{{ if .DocsURL }}For more information, see the [policy documentation]({{ .DocsURL }}).
-{{end}}`
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
 
-var conftestFlags = []string{"COMBINE", "POLICY", "ALL_NAMESPACES", "DATA"}
+type sarifDriver struct {
+	Name    string      `json:"name"`
+	Version string      `json:"version,omitempty"`
+	Rules   []sarifRule `json:"rules"`
+}
 
-func main() {
-	err := run()
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
+type sarifRule struct {
+	ID      string `json:"id"`
+	HelpURI string `json:"helpUri,omitempty"`
 }
 
-func run() error {
-	if os.Getenv("FILES") == "" {
-		return fmt.Errorf("at least one file to test must be supplied")
-	}
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
 
-	pullURL, err := getFullPullURL()
-	if err != nil {
-		return fmt.Errorf("get full pull url: %w", err)
-	}
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+}
 
-	if pullURL != "" {
-		if err := runConftestPull(pullURL); err != nil {
-			return fmt.Errorf("runnning conftest pull: %w", err)
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+// defaultSARIFRuleID is the rule of violations without a policy ID.
+const defaultSARIFRuleID = "conftest"
+
+// getSARIF returns a SARIF log with a result for each failure and warning, and
+// a rule for each of their policy IDs. docsURL is used as the help URI of the
+// rules when set.
+func getSARIF(fails, warns []violation, docsURL string) sarifLog {
+	driver := sarifDriver{Name: "conftest", Version: getVersion(), Rules: []sarifRule{}}
+	results := []sarifResult{}
+	for _, group := range []struct {
+		level      string
+		violations []violation
+	}{{"error", fails}, {"warning", warns}} {
+		for _, v := range group.violations {
+			ruleID := v.PolicyID
+			if ruleID == "" {
+				ruleID = defaultSARIFRuleID
+			}
+
+			known := false
+			for _, rule := range driver.Rules {
+				if rule.ID == ruleID {
+					known = true
+					break
+				}
+			}
+			if !known {
+				driver.Rules = append(driver.Rules, sarifRule{ID: ruleID, HelpURI: docsURL})
+			}
+
+			results = append(results, sarifResult{
+				RuleID:  ruleID,
+				Level:   group.level,
+				Message: sarifMessage{Text: v.Message},
+				Locations: []sarifLocation{{
+					PhysicalLocation: sarifPhysicalLocation{ArtifactLocation: sarifArtifactLocation{URI: filepath.ToSlash(v.Filename)}},
+				}},
+			})
 		}
 	}
 
-	results, err := runConftestTest()
+	return sarifLog{
+		Version: "2.1.0",
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Runs:    []sarifRun{{Tool: sarifTool{Driver: driver}, Results: results}},
+	}
+}
+
+// writeSARIF writes the SARIF log to path.
+func writeSARIF(path string, log sarifLog) error {
+	out, err := json.MarshalIndent(log, "", "  ")
 	if err != nil {
-		return fmt.Errorf("running conftest: %w", err)
+		return fmt.Errorf("marshalling sarif: %w", err)
 	}
 
-	metricsURL := os.Getenv("METRICS_URL")
-	policyIDKey := os.Getenv("POLICY_ID_KEY")
+	return ioutil.WriteFile(path, out, 0644)
+}
 
-	var policiesWithFails, policiesWithWarns []string
-	var fails, warns []string
-	var successes int
-	for _, result := range results {
-		successes += len(result.Successes)
+// attestation is an in-toto statement recording that the subjects were tested
+// against the policy bundle, and the outcome of the test.
+type attestation struct {
+	Type          string               `json:"_type"`
+	Subject       []attestationSubject `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     attestationPredicate `json:"predicate"`
+}
 
-		for _, fail := range result.Failures {
-			fails = append(fails, fmt.Sprintf("%s - %s", result.Filename, fail.Message))
-			policyID, err := getPolicyIDFromMetadata(fail.Metadata, policyIDKey)
-			if err != nil {
-				continue
-			}
-			if !contains(policiesWithFails, policyID) {
-				policiesWithFails = append(policiesWithFails, policyID)
-			}
+type attestationSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type attestationPredicate struct {
+	Policy  attestationPolicy `json:"policy"`
+	Result  attestationResult `json:"result"`
+	Version string            `json:"version"`
+}
+
+type attestationPolicy struct {
+	Path   string            `json:"path"`
+	Digest map[string]string `json:"digest"`
+}
+
+type attestationResult struct {
+	Passed    bool `json:"passed"`
+	Successes int  `json:"successes"`
+	Failures  int  `json:"failures"`
+	Warnings  int  `json:"warnings"`
+}
+
+const (
+	inTotoStatementType      = "https://in-toto.io/Statement/v0.1"
+	attestationPredicateType = "https://github.com/YubicoLabs/action-conftest/attestation/v1"
+)
+
+// getAttestation returns an in-toto statement with the tested files as the
+// subjects, and the digest of the policy bundle and the outcome as the
+// predicate.
+func getAttestation(files []string, successes, fails, warns int, passed bool) (attestation, error) {
+	statement := attestation{
+		Type:          inTotoStatementType,
+		Subject:       []attestationSubject{},
+		PredicateType: attestationPredicateType,
+		Predicate: attestationPredicate{
+			Result: attestationResult{
+				Passed:    passed,
+				Successes: successes,
+				Failures:  fails,
+				Warnings:  warns,
+			},
+			Version: getVersion(),
+		},
+	}
+
+	for _, file := range files {
+		// rendered manifests are read from stdin and have no file to digest
+		if file == "-" {
+			continue
 		}
 
-		for _, warn := range result.Warnings {
-			warns = append(warns, fmt.Sprintf("%s - %s", result.Filename, warn.Message))
-			policyID, err := getPolicyIDFromMetadata(warn.Metadata, policyIDKey)
-			if err != nil {
-				continue
-			}
-			if !contains(policiesWithWarns, policyID) {
-				policiesWithWarns = append(policiesWithWarns, policyID)
-			}
+		digest, err := getPathDigest(file)
+		if err != nil {
+			return attestation{}, fmt.Errorf("digesting %s: %w", file, err)
 		}
+		statement.Subject = append(statement.Subject, attestationSubject{Name: filepath.ToSlash(file), Digest: map[string]string{"sha256": digest}})
 	}
 
-	// attempt to submit metrics, but do not fail the CI job if there are errors
-	if metricsURL != "" {
-		sourceID := os.Getenv("METRICS_SOURCE")
-		if sourceID == "" {
-			return fmt.Errorf("metrics-source must be specified if metrics-url is set")
+	if content, ext, err := getInputFromEnv(); err != nil {
+		return attestation{}, err
+	} else if content != nil {
+		sum := sha256.Sum256(content)
+		statement.Subject = append(statement.Subject, attestationSubject{Name: "input." + ext, Digest: map[string]string{"sha256": hex.EncodeToString(sum[:])}})
+	}
+
+	policyDir := os.Getenv("POLICY")
+	if policyDir == "" {
+		policyDir = "policy"
+	}
+	digest, err := getPathDigest(policyDir)
+	if err != nil {
+		return attestation{}, fmt.Errorf("digesting policy bundle: %w", err)
+	}
+	statement.Predicate.Policy = attestationPolicy{Path: filepath.ToSlash(policyDir), Digest: map[string]string{"sha256": digest}}
+
+	return statement, nil
+}
+
+// getPathDigest returns the hex encoded SHA-256 digest of a file, or of a
+// directory. The digest of a directory covers the relative path and the digest
+// of every file in it, in lexical order, so it changes when any file is added,
+// removed, renamed or modified.
+func getPathDigest(root string) (string, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return "", err
+	}
+
+	if !info.IsDir() {
+		content, err := ioutil.ReadFile(root)
+		if err != nil {
+			return "", err
 		}
+		sum := sha256.Sum256(content)
+		return hex.EncodeToString(sum[:]), nil
+	}
 
-		metrics := metricsSubmission{
-			SourceID:  sourceID,
-			Successes: successes,
-			Failures: metricsSeverity{
-				Count:     len(fails),
-				PolicyIDs: policiesWithFails,
-			},
-			Warnings: metricsSeverity{
-				Count:     len(warns),
-				PolicyIDs: policiesWithWarns,
-			},
+	h := sha256.New()
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
 		}
-		if strings.ToLower(os.Getenv("METRICS_DETAILS")) == "true" {
-			metrics.Details = results
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
 		}
-		metricsJSON, err := json.Marshal(metrics)
+		content, err := ioutil.ReadFile(path)
 		if err != nil {
-			return fmt.Errorf("marshal metrics json: %w", err)
+			return err
 		}
+		sum := sha256.Sum256(content)
+		fmt.Fprintf(h, "%s\x00%s\n", filepath.ToSlash(rel), hex.EncodeToString(sum[:]))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
 
-		var metricsToken string
-		if os.Getenv("METRICS_TOKEN") != "" {
-			metricsToken = fmt.Sprintf("Bearer %s", os.Getenv("METRICS_TOKEN"))
-		}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
 
-		submitPost(metricsURL, metricsJSON, metricsToken)
+// writeAttestation writes the attestation to path.
+func writeAttestation(path string, statement attestation) error {
+	out, err := json.MarshalIndent(statement, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshalling attestation: %w", err)
 	}
 
-	if len(fails) == 0 && len(warns) == 0 {
-		fmt.Println("No policy violations or warnings were identified.")
-		return nil
+	return ioutil.WriteFile(path, out, 0644)
+}
+
+// annotation is an annotation of a file with a failure or warning.
+type annotation struct {
+	Path    string `json:"path"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+
+	// Line is always 1, as conftest does not report where in the file the
+	// violation is
+	Line int `json:"line"`
+}
+
+// getAnnotations returns an annotation for each failure and warning, with the
+// policy ID in front of the message when known.
+func getAnnotations(fails, warns []violation) []annotation {
+	annotations := []annotation{}
+	for _, group := range []struct {
+		level      string
+		violations []violation
+	}{{"error", fails}, {"warning", warns}} {
+		for _, v := range group.violations {
+			msg := v.Message
+			if v.PolicyID != "" {
+				msg = v.PolicyID + " " + msg
+			}
+			annotations = append(annotations, annotation{Path: v.Filename, Level: group.level, Message: msg, Line: 1})
+		}
 	}
 
-	d := commentData{Fails: fails, Warns: warns}
-	if os.Getenv("DOCS_URL") != "" {
-		d.DocsURL = os.Getenv("DOCS_URL")
+	return annotations
+}
+
+// printAnnotations writes an annotation for each failure and warning, so that
+// the violations are shown inline on the files they were found in.
+func printAnnotations(w io.Writer, fails, warns []violation) {
+	for _, a := range getAnnotations(fails, warns) {
+		fmt.Fprintf(w, "::%s file=%s::%s\n", a.Level, escapeAnnotationProperty(a.Path), escapeAnnotationData(a.Message))
 	}
+}
 
-	t, err := renderTemplate(d)
+// writeAnnotations writes the annotations to path as JSON, for CI systems
+// other than GitHub Actions to pick up.
+func writeAnnotations(path string, fails, warns []violation) error {
+	out, err := json.MarshalIndent(getAnnotations(fails, warns), "", "  ")
 	if err != nil {
-		return fmt.Errorf("rendering template: %w", err)
+		return fmt.Errorf("marshalling annotations: %w", err)
 	}
 
-	// ensure the results are written to the CI logs
-	fmt.Println(string(t))
+	return ioutil.WriteFile(path, out, 0644)
+}
+
+// escapeAnnotationData escapes the message of a workflow command.
+func escapeAnnotationData(s string) string {
+	s = strings.ReplaceAll(s, "%", "%25")
+	s = strings.ReplaceAll(s, "\r", "%0D")
+	return strings.ReplaceAll(s, "\n", "%0A")
+}
+
+// escapeAnnotationProperty escapes a property value of a workflow command,
+// such as the file or title.
+func escapeAnnotationProperty(s string) string {
+	s = escapeAnnotationData(s)
+	s = strings.ReplaceAll(s, ":", "%3A")
+	return strings.ReplaceAll(s, ",", "%2C")
+}
 
-	if os.Getenv("ADD_COMMENT") != "true" {
+// writeStepSummary appends s to the job summary of the step.
+func writeStepSummary(s string) error {
+	summaryFile := os.Getenv("GITHUB_STEP_SUMMARY")
+	if summaryFile == "" {
 		return nil
 	}
 
-	ghComment, err := getCommentJSON(t)
+	f, err := os.OpenFile(summaryFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		return fmt.Errorf("get comment json: %w", err)
-	}
-
-	ghToken := fmt.Sprintf("token %s", os.Getenv("GITHUB_TOKEN"))
-	if err := submitPost(os.Getenv("GITHUB_COMMENT_URL"), ghComment, ghToken); err != nil {
-		return fmt.Errorf("submitting comment: %w", err)
+		return fmt.Errorf("opening step summary file: %w", err)
 	}
+	defer f.Close()
 
-	if len(fails) > 0 {
-		if strings.ToLower(os.Getenv("NO_FAIL")) != "true" {
-			return fmt.Errorf("%d policy violations were found", len(fails))
-		}
+	if _, err := fmt.Fprint(f, s); err != nil {
+		return fmt.Errorf("writing step summary: %w", err)
 	}
 
 	return nil
 }
 
-func getFullPullURL() (string, error) {
-	pullURL := os.Getenv("PULL_URL")
-	if pullURL == "" {
-		return "", nil
+// renderTable renders the violations as a Markdown table. Violations without a
+// severity in their metadata are listed as a failure or warning.
+func renderTable(fails, warns []violation) string {
+	var b strings.Builder
+	b.WriteString("### Conftest results\n\n")
+	if len(fails) == 0 && len(warns) == 0 {
+		b.WriteString("No policy violations or warnings were identified.\n")
+		return b.String()
 	}
 
-	pullURLSplit := strings.Split(pullURL, "/")
-	if len(pullURLSplit) == 1 {
-		return "", fmt.Errorf("invalid url: %s", pullURL)
+	b.WriteString("| Severity | File | Policy | Message |\n")
+	b.WriteString("| --- | --- | --- | --- |\n")
+	for _, v := range withDefaultSeverity(fails, warns) {
+		fmt.Fprintf(&b, "| %s | %s | %s | %s |\n", escapeTableCell(v.Severity), escapeTableCell(v.Filename), escapeTableCell(v.PolicyID), escapeTableCell(v.Message))
 	}
 
-	pullSecret := os.Getenv("PULL_SECRET")
-	if pullSecret == "" {
-		return pullURL, nil
+	return b.String()
+}
+
+// renderJobSummary renders the results for the job summary, with the number of
+// passing checks and a table of the violations for each file.
+func renderJobSummary(successes int, fails, warns []violation) string {
+	var b strings.Builder
+	b.WriteString("### Conftest results\n\n")
+	fmt.Fprintf(&b, "%d checks passed, %d failed, %d warned.\n", successes, len(fails), len(warns))
+
+	var files []string
+	byFile := make(map[string][]violation)
+	for _, v := range withDefaultSeverity(fails, warns) {
+		if _, ok := byFile[v.Filename]; !ok {
+			files = append(files, v.Filename)
+		}
+		byFile[v.Filename] = append(byFile[v.Filename], v)
 	}
 
-	pullURI := pullURLSplit[0]
-	switch pullURI {
-	case "gcs::https:":
-		if err := ioutil.WriteFile("gcs.json", []byte(pullSecret), os.ModePerm); err != nil {
-			return "", fmt.Errorf("writing gcs creds: %w", err)
+	for _, file := range files {
+		fmt.Fprintf(&b, "\n#### %s\n\n", file)
+		b.WriteString("| Severity | Policy | Message |\n")
+		b.WriteString("| --- | --- | --- |\n")
+		for _, v := range byFile[file] {
+			fmt.Fprintf(&b, "| %s | %s | %s |\n", escapeTableCell(v.Severity), escapeTableCell(v.PolicyID), escapeTableCell(v.Message))
 		}
-		os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "gcs.json")
+	}
 
-	case "s3::https:":
-		pullURL = pullURL + "?" + pullSecret
+	return b.String()
+}
 
-	case "https:":
-		u, err := url.Parse(pullURL)
-		if err != nil {
-			return "", fmt.Errorf("parsing url: %w", err)
+// withDefaultSeverity returns the failures followed by the warnings, with those
+// without a severity in their metadata listed as a failure or warning.
+func withDefaultSeverity(fails, warns []violation) []violation {
+	var out []violation
+	for _, group := range []struct {
+		severity   string
+		violations []violation
+	}{{"failure", fails}, {"warning", warns}} {
+		for _, v := range group.violations {
+			if v.Severity == "" {
+				v.Severity = group.severity
+			}
+			out = append(out, v)
 		}
-		pullURL = "https://" + pullSecret + "@" + u.Host + u.Path
-
-	default:
-		return "", fmt.Errorf("PULL_SECRET not supported with uri: %s", pullURI)
 	}
 
-	return pullURL, nil
+	return out
 }
 
-func runConftestPull(url string) error {
-	cmd := exec.Command("conftest", "pull", url)
-	var out bytes.Buffer
-	cmd.Stderr = &out
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("%s", out.String())
+// escapeTableCell escapes s so that it stays within a single Markdown table
+// cell.
+func escapeTableCell(s string) string {
+	s = strings.ReplaceAll(s, "|", "\\|")
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// getTempDir returns the directory for temporary files. TMPDIR_OVERRIDE takes
+// precedence, followed by the runner's temp directory which is cleaned up at the
+// end of the job, and finally TMPDIR. RUNNER_TEMP is a path on the runner that
+// is not mounted into the action container, so it is only used when it exists.
+func getTempDir() string {
+	if dir := os.Getenv("TMPDIR_OVERRIDE"); dir != "" {
+		return dir
 	}
 
-	return nil
-}
+	if dir := os.Getenv("RUNNER_TEMP"); dir != "" {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+	}
 
-func runConftestTest() ([]jsonCheckResult, error) {
-	args := []string{"test", "--no-color", "--output", "json"}
-	flags := getFlagsFromEnv()
-	args = append(args, flags...)
-	files := strings.Split(os.Getenv("FILES"), " ")
-	args = append(args, files...)
+	return os.TempDir()
+}
 
-	cmd := exec.Command("conftest", args...)
-	out, _ := cmd.CombinedOutput() // intentionally ignore errors so we can parse the results
+// getSeverityFromMetadata returns the lowercased severity stored under key in
+// the details of the metadata, or an empty string when there is none.
+func getSeverityFromMetadata(metadata map[string]interface{}, key string) string {
+	if key == "" {
+		return ""
+	}
 
-	var results []jsonCheckResult
-	if err := json.Unmarshal(out, &results); err != nil {
-		return nil, fmt.Errorf("%s", string(out))
+	details, ok := metadata["details"].(map[string]interface{})
+	if !ok || details[key] == nil {
+		return ""
 	}
 
-	return results, nil
+	return strings.ToLower(fmt.Sprintf("%v", details[key]))
 }
 
-func getPolicyIDFromMetadata(metadata map[string]interface{}, policyIDKey string) (string, error) {
-	details := metadata["details"].(map[string]interface{})
-	if details[policyIDKey] == nil {
-		return "", fmt.Errorf("empty policyID key")
+// getRemediationFromMetadata returns the remediation_command of the policy from
+// the details in the metadata, or an empty string when show is false.
+func getRemediationFromMetadata(metadata map[string]interface{}, show bool) string {
+	if !show {
+		return ""
+	}
+
+	details, ok := metadata["details"].(map[string]interface{})
+	if !ok {
+		return ""
 	}
 
-	return fmt.Sprintf("%v", details[policyIDKey]), nil
+	command, _ := details["remediation_command"].(string)
+	return command
 }
 
-func getFlagsFromEnv() []string {
-	var args []string
-	for _, v := range conftestFlags {
-		env := os.Getenv(v)
-		if env == "" || strings.ToLower(env) == "false" {
-			continue
+// groupBySeverity groups the violations by their severity, ordered from most to
+// least severe, formatting the violations of each group with format. Violations
+// without a severity fall back to being grouped as a failure or a warning.
+func groupBySeverity(fails, warns []violation, format func([]violation) []string) []severityGroup {
+	var names []string
+	groups := make(map[string][]violation)
+	add := func(violations []violation, fallback string) {
+		for _, v := range violations {
+			severity := v.Severity
+			if severity == "" {
+				severity = fallback
+			}
+			if _, ok := groups[severity]; !ok {
+				names = append(names, severity)
+			}
+			groups[severity] = append(groups[severity], v)
 		}
+	}
+	add(fails, "failure")
+	add(warns, "warning")
 
-		flag := getFlagFromEnv(v)
-		if strings.ToLower(env) == "true" {
-			args = append(args, flag)
-		} else {
-			args = append(args, flag, env)
+	rank := func(severity string) int {
+		for i, s := range severityOrder {
+			if s == severity {
+				return i
+			}
+		}
+		switch severity {
+		case "failure":
+			return len(severityOrder) + 1
+		case "warning":
+			return len(severityOrder) + 2
 		}
+		return len(severityOrder)
 	}
+	sort.SliceStable(names, func(i, j int) bool {
+		if rank(names[i]) != rank(names[j]) {
+			return rank(names[i]) < rank(names[j])
+		}
+		return names[i] < names[j]
+	})
 
-	return args
+	var out []severityGroup
+	for _, name := range names {
+		out = append(out, severityGroup{
+			Name:       strings.ToUpper(name[:1]) + name[1:],
+			Violations: format(groups[name]),
+		})
+	}
+
+	return out
 }
 
-func renderTemplate(d commentData) ([]byte, error) {
-	t, err := template.New("conftest").Parse(commentTemplate)
-	if err != nil {
-		return nil, fmt.Errorf("parsing template: %w", err)
+func formatViolations(violations []violation) []string {
+	var out []string
+	for _, v := range violations {
+		out = append(out, formatViolation(v))
 	}
 
-	var o bytes.Buffer
-	if err := t.Execute(&o, d); err != nil {
-		return nil, fmt.Errorf("executing template: %w", err)
+	return out
+}
+
+// formatViolation formats the violation for the comment, followed by its
+// remediation command in a fenced code block so that it can be copied.
+func formatViolation(v violation) string {
+	return withRemediation(v.String(), v.Remediation)
+}
+
+// withRemediation appends the remediation command to line in a fenced code
+// block, unless there is none.
+func withRemediation(line, remediation string) string {
+	if remediation == "" {
+		return line
 	}
 
-	return o.Bytes(), nil
+	fence := "```"
+	for strings.Contains(remediation, fence) {
+		fence += "`"
+	}
+
+	return fmt.Sprintf("%s\n%ssh\n%s\n%s", line, fence, strings.TrimRight(remediation, "\n"), fence)
 }
 
-func getCommentJSON(comment []byte) ([]byte, error) {
-	j, err := json.Marshal(map[string]string{"body": string(comment)})
-	if err != nil {
-		return nil, fmt.Errorf("marshalling comment: %w", err)
+// coalesceViolations formats the violations, collapsing violations with the
+// same policy ID and message into a single line with the number of times the
+// violation occurred, followed by the remediation of the first of them.
+func coalesceViolations(violations []violation) []string {
+	type key struct{ policyID, message string }
+
+	var keys []key
+	counts := make(map[key]int)
+	first := make(map[key]violation)
+	for _, v := range violations {
+		k := key{v.PolicyID, v.Message}
+		if counts[k] == 0 {
+			keys = append(keys, k)
+			first[k] = v
+		}
+		counts[k]++
 	}
 
-	return j, nil
+	var out []string
+	for _, k := range keys {
+		if counts[k] == 1 {
+			out = append(out, formatViolation(first[k]))
+			continue
+		}
+
+		out = append(out, withRemediation(fmt.Sprintf("%s (×%d)", k.message, counts[k]), first[k].Remediation))
+	}
+
+	return out
 }
 
-func submitPost(url string, data []byte, authz string) error {
-	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
-	if err != nil {
-		return fmt.Errorf("creating http request: %w", err)
+// printSummary writes a human readable summary of the number of checks.
+func printSummary(w io.Writer, successes, fails, warns int) {
+	fmt.Fprintf(w, "%d checks passed, %d failed, %d warned\n", successes, fails, warns)
+}
+
+// printProgress writes a single status line for the result of a file.
+func printProgress(w io.Writer, result jsonCheckResult) {
+	status := "✔"
+	if len(result.Failures) > 0 {
+		status = "✖"
 	}
 
-	req.Header.Add("Content-Type", "application/json")
-	if authz != "" {
-		req.Header.Add("Authorization", authz)
+	fmt.Fprintf(w, "%s %s\n", status, result.Filename)
+}
+
+func getFlagFromEnv(e string) string {
+	return fmt.Sprintf("--%s", strings.ToLower(strings.ReplaceAll(e, "_", "-")))
+}
+
+// getListFromEnv returns the newline separated values of the environment
+// variable, skipping any empty lines.
+func getListFromEnv(e string) []string {
+	var values []string
+	for _, v := range strings.Split(os.Getenv(e), "\n") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		values = append(values, v)
 	}
 
-	c := http.Client{}
-	resp, err := c.Do(req)
+	return values
+}
+
+// getIntFromEnv returns the integer value of the environment variable, or the
+// default when it is not set.
+func getIntFromEnv(e string, def int) (int, error) {
+	env := os.Getenv(e)
+	if env == "" {
+		return def, nil
+	}
+
+	i, err := strconv.Atoi(env)
 	if err != nil {
-		return fmt.Errorf("submitting http request: %w", err)
+		return 0, fmt.Errorf("%s must be an integer: %w", e, err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		msg, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			msg = []byte(fmt.Sprintf("unable to read response body: %s", err))
-		}
+	return i, nil
+}
 
-		return fmt.Errorf("remote server error: status %d: %s", resp.StatusCode, string(msg))
+// getDurationFromEnv returns the duration value of the environment variable,
+// such as 30s or 5m, or the default when it is not set.
+func getDurationFromEnv(e string, def time.Duration) (time.Duration, error) {
+	env := os.Getenv(e)
+	if env == "" {
+		return def, nil
 	}
 
-	return nil
+	d, err := time.ParseDuration(env)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a duration such as 30s or 5m: %w", e, err)
+	}
+
+	return d, nil
 }
 
-func getFlagFromEnv(e string) string {
-	return fmt.Sprintf("--%s", strings.ToLower(strings.ReplaceAll(e, "_", "-")))
+// envEnabled reports whether the environment variable is set to true.
+func envEnabled(e string) bool {
+	return strings.ToLower(os.Getenv(e)) == "true"
 }
 
 func contains(list []string, item string) bool {